@@ -7,14 +7,16 @@
 
 void process_message(char *msg);
 void process_serial();
+void reply_ok(uint16_t seq);
+void reply_err(uint16_t seq, const char *reason);
 
 BarBot *bb;
 
 void setup()
 {
-  bb = new BarBot();
   Serial.begin(9600);      // For debug info only
-  Serial2.begin(115200);   // Communication with Pi
+  Serial2.begin(115200);   // Communication with Pi - needs to be started first, as BarBot reports its state on it
+  bb = new BarBot();
   Serial.println("Start!");
   
 }
@@ -59,25 +61,46 @@ void process_serial(void)
 void process_message(char *msg)
 {
   char instruction = 0;
+  uint16_t seq = 0;
   uint16_t param1 = 0;
   uint16_t param2 = 0;
-  uint8_t ret;
+  int ret;
   BarBot::barbot_state state;
   
   Serial.print("Process: ");
   Serial.println(msg);
   
-  ret = sscanf(msg, "%c %d %d", &instruction, &param1, &param2);
-  if (ret == 0)
+  // Messages from the Pi are prefixed with a sequence number, which is echoed back 
+  // in the OK/ERR reply so the Pi can match replies to the instructions it sent.
+  if (isdigit(msg[0]))
+  {
+    ret = sscanf(msg, "%u %c %u %u", &seq, &instruction, &param1, &param2);
+    ret--;
+  }
+  else
+    ret = sscanf(msg, "%c %u %u", &instruction, &param1, &param2);
+  
+  if (ret <= 0)
   {
     Serial.println("Invalid mesage");
+    reply_err(seq, "invalid message");
     return;
   }
   
   state = bb->get_state();
+  
+  // State query. Allowed at any time, so the Pi can find out what barbot is doing after (re)connecting.
+  if (instruction == 'S')
+  {
+    bb->report_state(state, NULL);
+    reply_ok(seq);
+    return;
+  }
+  
   if (state == BarBot::RUNNING)
   {
     Serial.println("Error - barbot is busy");
+    reply_err(seq, "busy");
     return;
   } 
 
@@ -88,25 +111,39 @@ void process_message(char *msg)
       break;
       
     case 'M':  // Move insturction. Param1 should be where to move to.
-      if (ret < 1)
+      if (ret < 2)
       {
         Serial.println(F("Error: parameter missing for Move"));
+        reply_err(seq, "parameter missing");
+        return;
+      }
+      if (!bb->instruction_add(BarBot::MOVE, param1, 0))
+      {
+        reply_err(seq, "instruction rejected");
         return;
       }
-      bb->instruction_add(BarBot::MOVE, param1, 0);  
       break;
       
     case 'D': // Dispense insturction. param1 = dispenser_id, param2 misc paramter for dispenser (purpose varies dependant on dispenser type)
-      if (ret < 2)
+      if (ret < 3)
       {
         Serial.println(F("Error: parameter missing for Dispense"));
+        reply_err(seq, "parameter missing");
+        return;
+      }
+      if (!bb->instruction_add(BarBot::DISPENSE, param1, param2))
+      {
+        reply_err(seq, "instruction rejected");
         return;
       }
-      bb->instruction_add(BarBot::DISPENSE, param1, param2);  
       break;
       
     case 'G': // GO!
-      bb->go();
+      if (!bb->go())
+      {
+        reply_err(seq, "go failed");
+        return;
+      }
       break;
       
     case 'R':  // Reset. Clear all instructions, return to home, set IDLE state
@@ -117,13 +154,30 @@ void process_message(char *msg)
       bb->instructions_clear();
       bb->instruction_add(BarBot::ZERO, 0, 0);  
       bb->go();
+      break;
      
     default:
       Serial.println("Unexpected instruction!");
+      reply_err(seq, "unexpected instruction");
       return;
       break;
   }
- 
+  
+  reply_ok(seq);
 }
 
+// Acknowledge an instruction: "OK <seq>"
+void reply_ok(uint16_t seq)
+{
+  Serial2.print("OK ");
+  Serial2.println(seq);
+}
 
+// Reject an instruction: "ERR <seq> <reason>"
+void reply_err(uint16_t seq, const char *reason)
+{
+  Serial2.print("ERR ");
+  Serial2.print(seq);
+  Serial2.print(" ");
+  Serial2.println(reason);
+}
@@ -104,14 +104,16 @@ bool BarBot::instructions_clear()
     _instruction_count = 0;
     return true;
   }
+  return false;
 }
 
 bool BarBot::reset()
 {
-  set_state(BarBot::FAULT); // Ensure stopped
+  set_state(BarBot::FAULT, "reset"); // Ensure stopped
   instructions_clear();
   move_to(0);
   set_state(BarBot::IDLE);
+  return true;
 }
 
 // Make the drink!
@@ -219,7 +221,7 @@ bool BarBot::loop()
   ))
   {
     debug("Error: limit switch unexpectedly hit!");
-    set_state(BarBot::FAULT);
+    set_state(BarBot::FAULT, "limit switch hit");
   }
   
   _stepper->run();
@@ -228,7 +230,7 @@ bool BarBot::loop()
   if ((_state != BarBot::FAULT) && (digitalRead(ESTOP_PIN) == HIGH))
   {
     debug("ESTOP");
-    set_state(BarBot::FAULT);
+    set_state(BarBot::FAULT, "emergency stop");
   }
   
   // If waiting (for a glass), and a glass is now present, start making the drink
@@ -247,7 +249,7 @@ bool BarBot::loop()
   if ((_state == BarBot::RUNNING) && (!glass_present()))
   {
     debug("Glass removed.");
-    set_state(BarBot::FAULT);
+    set_state(BarBot::FAULT, "glass removed");
     return false;
   }
 
@@ -269,7 +271,7 @@ bool BarBot::loop()
         if ((millis()-_move_start) > MAX_MOVE_TIME)
         {
           debug("Move timeout!");
-          set_state(BarBot::FAULT);
+          set_state(BarBot::FAULT, "move timeout");
         } 
         break;
         
@@ -299,13 +301,13 @@ bool BarBot::loop()
         else if (_stepper->distanceToGo() == 0)
         {
           debug("FAULT: distanceToGo=0 whilst zeroing!");
-          set_state(BarBot::FAULT);
+          set_state(BarBot::FAULT, "zero failed");
           _stepper->setMaxSpeed(SPEED_NORMAL);
         }
         else if (millis()-_move_start > MAX_MOVE_TIME)
         {
           debug("FAULT: ZERO timeout");
-          set_state(BarBot::FAULT);
+          set_state(BarBot::FAULT, "zero timeout");
           _stepper->setMaxSpeed(SPEED_NORMAL);
         }
         break;
@@ -328,7 +330,8 @@ bool BarBot::loop()
   return false;
 }
 
-void BarBot::set_state(barbot_state new_state)
+// Change state, and report the new state to the Pi. reason is optional, and describes why a FAULT occurred.
+void BarBot::set_state(barbot_state new_state, const char *reason)
 {  
   if (new_state == BarBot::FAULT)
   {
@@ -358,9 +361,31 @@ void BarBot::set_state(barbot_state new_state)
     return;
   }   
   
+  if (new_state != _state)
+    report_state(new_state, reason);
+  
   _state = new_state;  
 }
 
+// Send a state change message to the Pi: "S <state> [reason]"
+void BarBot::report_state(barbot_state state, const char *reason)
+{
+  switch (state)
+  {
+    case BarBot::IDLE:    Serial2.print("S IDLE");    break;
+    case BarBot::WAITING: Serial2.print("S WAITING"); break;
+    case BarBot::RUNNING: Serial2.print("S RUNNING"); break;
+    case BarBot::FAULT:   Serial2.print("S FAULT");   break;
+  }
+  
+  if (reason != NULL)
+  {
+    Serial2.print(" ");
+    Serial2.print(reason);
+  }
+  Serial2.println();
+}
+
 void BarBot::move_to(long pos)
 {
   char buf[30]="";
@@ -64,6 +64,7 @@ class BarBot
     bool reset();
     bool loop();
     barbot_state get_state();
+    void report_state(barbot_state state, const char *reason);
 
       
   private:
@@ -76,7 +77,7 @@ class BarBot
          
     bool exec_instruction(uint16_t instruction);
     void move_to(long pos);
-    void set_state(barbot_state state);
+    void set_state(barbot_state state, const char *reason = NULL);
     
     barbot_state _state;
     instruction _instructions[MAX_INSTRUCTIONS];
@@ -1,7 +1,11 @@
 -- Naming conventions:
 -- _ts means timestamp
 
+DROP TABLE user_session;
+DROP TABLE user_account;
+DROP TABLE drink_order_status;
 DROP TABLE drink_order;
+DROP TABLE recipe_tag;
 DROP TABLE recipe_ingredient;
 DROP TABLE recipe;
 DROP TABLE ingredient;
@@ -17,7 +21,19 @@ CREATE TABLE drink_order (
     id_checked          BOOLEAN NOT NULL,
     cancelled           BOOLEAN NOT NULL,
     made_start_ts       INTEGER NULL,
-    made_end_ts         INTEGER NULL
+    made_end_ts         INTEGER NULL,
+    fail_reason         TEXT NULL,
+    status              VARCHAR(32) NOT NULL DEFAULT 'queued',
+    status_ts           INTEGER NULL,
+    size                VARCHAR(16) NOT NULL DEFAULT 'single'
+);
+
+-- History of drink_order.status changes
+CREATE TABLE drink_order_status (
+    drink_order_id      REFERENCES drink_order(id),
+    status              VARCHAR(32) NOT NULL,
+    status_ts           INTEGER NOT NULL,
+    reason              TEXT NULL
 );
 
 CREATE TABLE recipe ( 
@@ -42,10 +58,18 @@ CREATE TABLE recipe_ingredient (
     seq                 INTEGER NOT NULL,
     qty                 INTEGER NOT NULL,
 	dispenser_param		INTEGER,
+    step_group          INTEGER NULL,       -- Consecutive ingredients in the same group can be dispensed in any order
     PRIMARY KEY ( recipe_id, ingredient_id ),
     UNIQUE (recipe_id, seq)
 );
 
+-- Free text tags (e.g. "classic", "non-alcoholic"), kept with recipes when they're imported/exported
+CREATE TABLE recipe_tag (
+    recipe_id           REFERENCES recipe(id),
+    tag                 VARCHAR(64) NOT NULL,
+    PRIMARY KEY ( recipe_id, tag )
+);
+
 CREATE TABLE dispenser_type (
     id                  INTEGER PRIMARY KEY AUTOINCREMENT,
     name                VARCHAR(255) NOT NULL,
@@ -60,7 +84,10 @@ CREATE TABLE dispenser (
     dispenser_type_id   REFERENCES dispenser_type(id),
     ingredient_id       REFERENCES ingredient(id),
     name                VARCHAR(64),
-    rail_position       INTEGER NOT NULL
+    rail_position       INTEGER NOT NULL,
+    capacity            INTEGER NULL,       -- How much a full bottle holds (ml, dashes, etc.); null if not tracked
+    stock               INTEGER NULL,       -- How much is left
+    low_stock           INTEGER NULL        -- Level to alert at; null to use the default (-low-stock)
 );
 
 CREATE TABLE glass_type (
@@ -70,3 +97,19 @@ CREATE TABLE glass_type (
 	description			TEXT
 );
 
+-- Logins for the order list / admin pages. role is customer, bartender or admin.
+CREATE TABLE user_account (
+    id                  INTEGER PRIMARY KEY AUTOINCREMENT,
+    username            VARCHAR(64) NOT NULL UNIQUE,
+    password_hash       VARCHAR(255) NOT NULL,
+    role                VARCHAR(32) NOT NULL,
+    create_ts           INTEGER NOT NULL
+);
+
+CREATE TABLE user_session (
+    token               VARCHAR(64) PRIMARY KEY,
+    csrf_token          VARCHAR(64) NOT NULL,
+    user_id             REFERENCES user_account(id),
+    create_ts           INTEGER NOT NULL,
+    expires_ts          INTEGER NOT NULL
+);
@@ -0,0 +1,4 @@
+-- Adds a per-dispenser low stock alert level. If null, the default (-low-stock, a percentage of the
+-- dispenser's capacity) is used.
+
+ALTER TABLE dispenser ADD COLUMN low_stock INTEGER NULL;
@@ -0,0 +1,5 @@
+-- Adds stock tracking to dispensers. Both columns are in the units shown to the user (e.g. ml for
+-- optics and mixers, dashes for dashers). Dispensers with a null capacity are never treated as empty.
+
+ALTER TABLE dispenser ADD COLUMN capacity INTEGER NULL;
+ALTER TABLE dispenser ADD COLUMN stock INTEGER NULL;
@@ -0,0 +1,4 @@
+-- Adds drink_order.fail_reason to an existing database.
+-- fail_reason is set when barbot reports a FAULT whilst making the drink.
+
+ALTER TABLE drink_order ADD COLUMN fail_reason TEXT NULL;
@@ -0,0 +1,3 @@
+-- Adds the size a drink was ordered in: single, double or fit (scaled to fill the glass).
+
+ALTER TABLE drink_order ADD COLUMN size VARCHAR(16) NOT NULL DEFAULT 'single';
@@ -0,0 +1,22 @@
+-- Adds drink_order.status, and the drink_order_status history table, to an existing database.
+-- Existing orders are given a status based on the cancelled/made_*_ts/fail_reason columns.
+
+ALTER TABLE drink_order ADD COLUMN status VARCHAR(32) NOT NULL DEFAULT 'queued';
+ALTER TABLE drink_order ADD COLUMN status_ts INTEGER NULL;
+
+UPDATE drink_order SET status = 'id-check-required' WHERE alcohol = 1 AND id_checked = 0;
+UPDATE drink_order SET status = 'dispatched', status_ts = made_start_ts WHERE made_start_ts IS NOT NULL;
+UPDATE drink_order SET status = 'failed' WHERE fail_reason IS NOT NULL;
+UPDATE drink_order SET status = 'done', status_ts = made_end_ts WHERE made_end_ts IS NOT NULL;
+UPDATE drink_order SET status = 'cancelled' WHERE cancelled = 1;
+UPDATE drink_order SET status_ts = create_ts WHERE status_ts IS NULL;
+
+CREATE TABLE drink_order_status (
+    drink_order_id      REFERENCES drink_order(id),
+    status              VARCHAR(32) NOT NULL,
+    status_ts           INTEGER NOT NULL,
+    reason              TEXT NULL
+);
+
+INSERT INTO drink_order_status (drink_order_id, status, status_ts, reason)
+SELECT id, status, status_ts, fail_reason FROM drink_order;
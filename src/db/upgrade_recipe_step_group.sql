@@ -0,0 +1,4 @@
+-- Adds recipe_ingredient.step_group: consecutive ingredients (in seq order) with the same step_group can be
+-- dispensed in any order, so the planner can reorder them to save travel along the rail.
+
+ALTER TABLE recipe_ingredient ADD COLUMN step_group INTEGER NULL;
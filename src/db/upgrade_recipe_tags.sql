@@ -0,0 +1,7 @@
+-- Adds recipe tags, used by recipe import/export
+
+CREATE TABLE recipe_tag (
+    recipe_id           REFERENCES recipe(id),
+    tag                 VARCHAR(64) NOT NULL,
+    PRIMARY KEY ( recipe_id, tag )
+);
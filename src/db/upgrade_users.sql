@@ -0,0 +1,18 @@
+-- Adds the user_account and user_session tables, for logging in to the order list and admin pages.
+-- Add users with: go run *.go -adduser <name> -role <customer|bartender|admin>
+
+CREATE TABLE user_account (
+    id                  INTEGER PRIMARY KEY AUTOINCREMENT,
+    username            VARCHAR(64) NOT NULL UNIQUE,
+    password_hash       VARCHAR(255) NOT NULL,
+    role                VARCHAR(32) NOT NULL,
+    create_ts           INTEGER NOT NULL
+);
+
+CREATE TABLE user_session (
+    token               VARCHAR(64) PRIMARY KEY,
+    csrf_token          VARCHAR(64) NOT NULL,
+    user_id             REFERENCES user_account(id),
+    create_ts           INTEGER NOT NULL,
+    expires_ts          INTEGER NOT NULL
+);
@@ -0,0 +1,137 @@
+package main
+
+import (
+  "bytes"
+  "database/sql"
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "sync"
+  "time"
+)
+
+/*
+ * Low stock alerts. A dispenser is "low" once its stock falls to its threshold (dispenser.low_stock, or
+ * LowStockPercent of its capacity if that isn't set), and "empty" once there isn't enough left for one
+ * measure. Alerts are shown at the top of the admin pages and on the order list, and can also be posted
+ * (as JSON) to a webhook, e.g. something on the Pi that sends a text to the bar manager.
+ */
+
+const (
+  ALERT_LOW   = "low"
+  ALERT_EMPTY = "empty"
+
+  WEBHOOK_TIMEOUT = 5 * time.Second
+)
+
+var LowStockPercent = 20   // Set by -low-stock
+var AlertWebhook string    // Set by -alert-webhook
+
+type StockAlert struct {
+  DispenserId  int     `json:"dispenser_id"`
+  Dispenser    string  `json:"dispenser"`
+  Ingredient   string  `json:"ingredient"`
+  Level        string  `json:"level"`     // ALERT_LOW or ALERT_EMPTY
+  Stock        int     `json:"stock"`
+  Capacity     int     `json:"capacity"`
+  UoM          string  `json:"uom"`
+}
+
+// Alert levels already sent to the webhook, so each is only sent once (until the dispenser is restocked)
+var alertsSent = make(map[int]string)
+var alertsSentMu sync.Mutex
+
+// getStockAlerts returns all dispensers that are low or empty
+func getStockAlerts(db *sql.DB) []StockAlert {
+  var alerts []StockAlert
+
+  sqlstr := `
+    select
+      d.id,
+      d.name,
+      ifnull(i.name, ''),
+      d.stock,
+      d.capacity,
+      ifnull(d.low_stock, d.capacity * ? / 100),
+      dt.unit_size,
+      dt.unit_plural
+    from dispenser d
+    inner join dispenser_type dt on dt.id = d.dispenser_type_id
+    left outer join ingredient i on i.id = d.ingredient_id
+    where d.capacity is not null
+      and d.stock is not null
+      and dt.manual = 0
+    order by d.id`
+
+  rows, err := db.Query(sqlstr, LowStockPercent)
+  if err != nil {
+    // Also called from the dispatcher, so don't panic
+    fmt.Printf("getStockAlerts failed: %v\n", err)
+    return nil
+  }
+  defer rows.Close()
+
+  for rows.Next() {
+    var alert StockAlert
+    var low_stock int
+    var unit_size int
+    rows.Scan(&alert.DispenserId, &alert.Dispenser, &alert.Ingredient, &alert.Stock, &alert.Capacity, &low_stock, &unit_size, &alert.UoM)
+
+    switch {
+      case alert.Stock < unit_size:
+        alert.Level = ALERT_EMPTY
+      case alert.Stock <= low_stock:
+        alert.Level = ALERT_LOW
+      default:
+        continue
+    }
+    alerts = append(alerts, alert)
+  }
+
+  return alerts
+}
+
+// checkStockAlerts sends any new alerts to the webhook (if there is one). Called whenever stock is used.
+func checkStockAlerts(db *sql.DB) {
+  alerts := getStockAlerts(db)
+
+  alertsSentMu.Lock()
+  defer alertsSentMu.Unlock()
+
+  current := make(map[int]string)
+  for _, alert := range alerts {
+    current[alert.DispenserId] = alert.Level
+    if alertsSent[alert.DispenserId] == alert.Level {
+      continue
+    }
+
+    fmt.Printf("checkStockAlerts: %s (%s) is %s - %d %s left\n", alert.Dispenser, alert.Ingredient, alert.Level, alert.Stock, alert.UoM)
+    if AlertWebhook != "" {
+      go sendAlertWebhook(alert)
+    }
+  }
+
+  // Forget about dispensers that have been restocked, so they alert again next time they run low
+  alertsSent = current
+}
+
+// sendAlertWebhook posts an alert to the webhook
+func sendAlertWebhook(alert StockAlert) {
+  body, err := json.Marshal(alert)
+  if err != nil {
+    fmt.Printf("sendAlertWebhook: %v\n", err)
+    return
+  }
+
+  client := http.Client{Timeout: WEBHOOK_TIMEOUT}
+  resp, err := client.Post(AlertWebhook, "application/json", bytes.NewReader(body))
+  if err != nil {
+    fmt.Printf("sendAlertWebhook: %v\n", err)
+    return
+  }
+  resp.Body.Close()
+
+  if resp.StatusCode >= 300 {
+    fmt.Printf("sendAlertWebhook: %s returned %s\n", AlertWebhook, resp.Status)
+  }
+}
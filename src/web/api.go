@@ -0,0 +1,550 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "net/http"
+  "strconv"
+  "strings"
+)
+
+/*
+ * JSON API, for kiosks, phones and scripts. Uses the same functions as the HTML pages.
+ *
+ *   GET  /api/v1/recipes                  Drinks that can currently be made
+ *   GET  /api/v1/recipes/<id>             A drink and its ingredients
+ *   GET  /api/v1/orders                   Orders that haven't been finished or cancelled
+ *   POST /api/v1/orders                   Order a drink: {"recipe_id": n, "size": "single|double|fit"}
+ *   GET  /api/v1/orders/<ref>             An order, with its status history
+ *   POST /api/v1/orders/<ref>/idcheck     Bartender has checked the customer's ID
+ *   POST /api/v1/orders/<ref>/make        Queue the order to be made
+ *   POST /api/v1/orders/<ref>/complete    Mark the order as done
+ *   POST /api/v1/orders/<ref>/cancel      Cancel the order
+ *   GET  /api/v1/dispensers               Dispensers, and the ingredients each could be loaded with
+ *   PUT  /api/v1/dispensers/<id>          Change the ingredient loaded and/or stock: {"ingredient_id": n, "capacity": n, "stock": n, "low_stock": n}
+ *   POST /api/v1/dispensers/<id>/restock  Mark the dispenser as full
+ *   POST /api/v1/control/<reset|zero>     Send a control instruction to barbot
+ *   GET  /api/v1/status                   Link, barbot and dispatcher status, and low stock alerts
+ *   GET  /api/v1/session                  Who's logged in
+ *   POST /api/v1/session                  Log in: {"username": "...", "password": "..."}
+ *   DELETE /api/v1/session                Log out
+ *
+ * The same roles apply as for the HTML pages: bartender for the order list and making orders, admin for
+ * dispensers and control. Logging in sets the session cookie, and returns the CSRF token - this must be
+ * sent in an X-CSRF-Token header with every POST, PUT or DELETE whilst logged in.
+ *
+ * Errors are returned as {"error": "<message>"}, with a status code of:
+ *   400 - bad request (e.g. invalid JSON, or a size of drink that won't fit in the glass)
+ *   401 - not logged in
+ *   403 - logged in, but without the role needed; or missing CSRF token
+ *   404 - no such recipe / order / dispenser
+ *   405 - method not allowed for that path
+ *   409 - the order isn't in a state that allows the request (e.g. making a cancelled order), or can't be made
+ *   502 - barbot rejected or didn't reply to an instruction
+ *   503 - not connected to barbot
+ */
+
+type ApiError struct {
+  Error  string  `json:"error"`
+}
+
+type ApiOrder struct {
+  OrderRef     string                `json:"ref"`
+  DrinkName    string                `json:"drink"`
+  Status       string                `json:"status"`
+  Size         string                `json:"size"`
+  Message      string                `json:"message"`   // Status, as shown to the customer
+  Alcohol      bool                  `json:"alcohol"`
+  IdCheck      bool                  `json:"id_checked"`
+  FailReason   string                `json:"fail_reason,omitempty"`
+  Glass        string                `json:"glass"`
+  Position     int                   `json:"position,omitempty"`  // Position in the dispatcher queue
+  Ingredients  []MenuItemIngredient  `json:"ingredients"`
+  History      []OrderStatusChange   `json:"history"`
+}
+
+type ApiNewOrder struct {
+  RecipeId  int     `json:"recipe_id"`
+  Size      string  `json:"size"`   // Defaults to single
+}
+
+// Fields left out of the request are left as they are
+type ApiDispenserUpdate struct {
+  IngredientId  *int  `json:"ingredient_id"`
+  Capacity      *int  `json:"capacity"`
+  Stock         *int  `json:"stock"`
+  LowStock      *int  `json:"low_stock"`
+}
+
+type ApiLogin struct {
+  Username  string  `json:"username"`
+  Password  string  `json:"password"`
+}
+
+type ApiSession struct {
+  Username  string  `json:"username"`
+  Role      string  `json:"role"`
+  Csrf      string  `json:"csrf_token"`
+}
+
+type ApiStatus struct {
+  Link        LinkStatus        `json:"link"`
+  Machine     MachineStatus     `json:"machine"`
+  Dispatcher  DispatcherStatus  `json:"dispatcher"`
+  Alerts      []StockAlert      `json:"alerts"`
+}
+
+// apiHandler handles requests to /api/v1/
+func apiHandler(w http.ResponseWriter, r *http.Request) {
+  // Database errors panic, as they do for the HTML pages; return them as JSON rather than dropping the connection
+  defer func() {
+    if err := recover(); err != nil {
+      fmt.Printf("apiHandler: %s %s failed: %v\n", r.Method, r.URL.Path, err)
+      apiError(w, http.StatusInternalServerError, fmt.Sprintf("%v", err))
+    }
+  }()
+
+  path := strings.Trim(r.URL.Path[len("/api/v1/"):], "/")
+  parts := strings.Split(path, "/")
+
+  db := getDBConnection()
+  defer db.Close()
+
+  if parts[0] == "session" {
+    apiSession(db, w, r)
+    return
+  }
+
+  // Logged in requests that change something need the CSRF token, in case they've come from another site
+  if r.Method != "GET" && getRequestSession(r) != nil && !csrfValid(r) {
+    apiError(w, http.StatusForbidden, "invalid or missing CSRF token")
+    return
+  }
+
+  switch parts[0] {
+    case "recipes":
+      if !apiRole(w, r, ROLE_CUSTOMER) {
+        return
+      }
+      apiRecipes(db, w, r, parts[1:])
+    case "orders":
+      apiOrders(db, w, r, parts[1:])
+    case "dispensers":
+      if !apiRole(w, r, ROLE_ADMIN) {
+        return
+      }
+      apiDispensers(db, w, r, parts[1:])
+    case "control":
+      if !apiRole(w, r, ROLE_ADMIN) {
+        return
+      }
+      apiControl(w, r, parts[1:])
+    case "status":
+      if !apiRole(w, r, ROLE_BARTENDER) || !apiMethod(w, r, "GET") {
+        return
+      }
+      apiWrite(w, http.StatusOK, ApiStatus{
+        Link:       BarbotLink.Snapshot(),
+        Machine:    BarbotMachine.Snapshot(),
+        Dispatcher: BarbotDispatcher.Status(),
+        Alerts:     getStockAlerts(db),
+      })
+    default:
+      apiError(w, http.StatusNotFound, "not found")
+  }
+}
+
+func apiRecipes(db *sql.DB, w http.ResponseWriter, r *http.Request, parts []string) {
+  if !apiMethod(w, r, "GET") {
+    return
+  }
+
+  if len(parts) == 0 {
+    recipes := getAvailableRecipes(db)
+    if recipes == nil {
+      recipes = []Recipe{}
+    }
+    apiWrite(w, http.StatusOK, recipes)
+    return
+  }
+
+  if len(parts) > 1 {
+    apiError(w, http.StatusNotFound, "not found")
+    return
+  }
+
+  menuitem, err := getMenuItem(db, parts[0])
+  if err != nil {
+    apiError(w, http.StatusNotFound, "recipe not found")
+    return
+  }
+  apiWrite(w, http.StatusOK, menuitem)
+}
+
+func apiOrders(db *sql.DB, w http.ResponseWriter, r *http.Request, parts []string) {
+  if len(parts) == 0 {
+    switch r.Method {
+      case "GET":
+        if !apiRole(w, r, ROLE_BARTENDER) {
+          return
+        }
+        orders := []ApiOrder{}
+        for _, id := range getActiveOrders(db) {
+          if order, ok := apiGetOrder(db, id); ok {
+            orders = append(orders, order)
+          }
+        }
+        apiWrite(w, http.StatusOK, orders)
+
+      case "POST":
+        if !apiRole(w, r, ROLE_CUSTOMER) {
+          return
+        }
+        var req ApiNewOrder
+        if !apiRead(w, r, &req) {
+          return
+        }
+        if req.Size == "" {
+          req.Size = SIZE_SINGLE
+        }
+        drink_order_id, err := createOrder(db, strconv.Itoa(req.RecipeId), req.Size)
+        if err == sql.ErrNoRows {
+          apiError(w, http.StatusNotFound, "recipe not found")
+          return
+        }
+        if err == ErrGlassTooSmall || err == ErrUnknownSize {
+          apiError(w, http.StatusBadRequest, err.Error())
+          return
+        }
+        if err != nil {
+          apiError(w, http.StatusInternalServerError, err.Error())
+          return
+        }
+        apiWriteOrder(db, w, http.StatusCreated, drink_order_id)
+
+      default:
+        apiMethodNotAllowed(w, "GET, POST")
+    }
+    return
+  }
+
+  drink_order_id, err := strconv.Atoi(parts[0])
+  if err != nil || len(parts) > 2 {
+    apiError(w, http.StatusNotFound, "not found")
+    return
+  }
+
+  // Anyone can see how an order is getting on, as with /status/<ref>
+  if len(parts) == 1 {
+    if !apiMethod(w, r, "GET") {
+      return
+    }
+    apiWriteOrder(db, w, http.StatusOK, drink_order_id)
+    return
+  }
+
+  if !apiRole(w, r, ROLE_BARTENDER) || !apiMethod(w, r, "POST") {
+    return
+  }
+
+  switch parts[1] {
+    case "idcheck":
+      err = setOrderStatus(db, drink_order_id, ORDER_QUEUED, "ID checked")
+    case "make":
+      _, err = queueOrder(db, drink_order_id)
+    case "complete":
+      err = setOrderStatus(db, drink_order_id, ORDER_DONE, "completed by bartender")
+    case "cancel":
+      err = cancelOrder(db, drink_order_id)
+    default:
+      apiError(w, http.StatusNotFound, "not found")
+      return
+  }
+
+  if err != nil {
+    apiOrderError(w, err)
+    return
+  }
+  apiWriteOrder(db, w, http.StatusOK, drink_order_id)
+}
+
+// apiGetOrder returns the details of an order, in the form returned by the API
+func apiGetOrder(db *sql.DB, drink_order_id int) (ApiOrder, bool) {
+  details, err := getOrderDetails(db, drink_order_id)
+  if err != nil {
+    return ApiOrder{}, false
+  }
+
+  order := ApiOrder{
+    OrderRef:    details.OrderRef,
+    DrinkName:   details.DrinkName,
+    Status:      details.Status,
+    Size:        details.Size,
+    Message:     customerStatusMessage(details.Status),
+    Alcohol:     details.Alcohol,
+    IdCheck:     details.IdCheck,
+    FailReason:  details.FailReason,
+    Glass:       details.Glass.Name,
+    Ingredients: details.Ingredients,
+    History:     details.History,
+  }
+
+  for ix, ref := range BarbotDispatcher.Status().Queue {
+    if ref == order.OrderRef {
+      order.Position = ix + 1
+    }
+  }
+  return order, true
+}
+
+func apiWriteOrder(db *sql.DB, w http.ResponseWriter, code int, drink_order_id int) {
+  order, ok := apiGetOrder(db, drink_order_id)
+  if !ok {
+    apiError(w, http.StatusNotFound, "order not found")
+    return
+  }
+  apiWrite(w, code, order)
+}
+
+// apiOrderError returns an error from changing the status of an order
+func apiOrderError(w http.ResponseWriter, err error) {
+  var transitionErr *OrderTransitionError
+  var instructionErr *InstructionError
+
+  switch {
+    case errors.Is(err, ErrOrderNotFound):
+      apiError(w, http.StatusNotFound, err.Error())
+    case errors.As(err, &transitionErr), errors.Is(err, ErrMissingIngredients), errors.Is(err, ErrNothingToDispense), errors.Is(err, ErrGlassTooSmall), errors.As(err, &instructionErr):
+      apiError(w, http.StatusConflict, err.Error())
+    default:
+      apiError(w, http.StatusInternalServerError, err.Error())
+  }
+}
+
+func apiDispensers(db *sql.DB, w http.ResponseWriter, r *http.Request, parts []string) {
+  if len(parts) == 0 {
+    if !apiMethod(w, r, "GET") {
+      return
+    }
+    apiWrite(w, http.StatusOK, getDispensers(db))
+    return
+  }
+
+  if len(parts) > 2 || (len(parts) == 2 && parts[1] != "restock") {
+    apiError(w, http.StatusNotFound, "not found")
+    return
+  }
+
+  dispenser, ok := apiFindDispenser(db, parts[0])
+  if !ok {
+    apiError(w, http.StatusNotFound, "dispenser not found")
+    return
+  }
+  dispenser_id := strconv.Itoa(dispenser.Id)
+
+  if len(parts) == 2 {
+    if !apiMethod(w, r, "POST") {
+      return
+    }
+    err := restockDispenser(db, dispenser_id)
+    if err != nil {
+      apiError(w, http.StatusInternalServerError, err.Error())
+      return
+    }
+    dispenser, _ = apiFindDispenser(db, parts[0])
+    apiWrite(w, http.StatusOK, dispenser)
+    return
+  }
+
+  if !apiMethod(w, r, "PUT") {
+    return
+  }
+
+  var req ApiDispenserUpdate
+  if !apiRead(w, r, &req) {
+    return
+  }
+
+  if req.IngredientId != nil {
+    // Only allow ingredients that can go in this type of dispenser, as the admin page does
+    allowed := false
+    for _, ingr := range dispenser.Ingredients {
+      if ingr.Id == *req.IngredientId {
+        allowed = true
+      }
+    }
+    if !allowed {
+      apiError(w, http.StatusBadRequest, fmt.Sprintf("ingredient %d can't be used in dispenser %d", *req.IngredientId, dispenser.Id))
+      return
+    }
+
+    err := setDispenserIngredient(db, dispenser_id, strconv.Itoa(*req.IngredientId))
+    if err != nil {
+      apiError(w, http.StatusInternalServerError, err.Error())
+      return
+    }
+  }
+
+  if req.Capacity != nil || req.Stock != nil || req.LowStock != nil {
+    dispenser, _ = apiFindDispenser(db, parts[0])
+    capacity := dispenser.Capacity
+    if req.Capacity != nil {
+      capacity = *req.Capacity
+    }
+    stock := dispenser.Stock
+    if req.Stock != nil {
+      stock = *req.Stock
+    } else if !dispenser.Tracked {
+      // Starting to track it - assume it's full
+      stock = capacity
+    }
+
+    low_stock := dispenser.LowStock
+    if req.LowStock != nil {
+      low_stock = *req.LowStock
+    }
+
+    err := setDispenserStock(db, dispenser_id, capacity, stock, low_stock)
+    if err != nil {
+      apiError(w, http.StatusInternalServerError, err.Error())
+      return
+    }
+  }
+
+  dispenser, _ = apiFindDispenser(db, parts[0])
+  apiWrite(w, http.StatusOK, dispenser)
+}
+
+func apiFindDispenser(db *sql.DB, id string) (DispenserDetails, bool) {
+  for _, dispenser := range getDispensers(db) {
+    if strconv.Itoa(dispenser.Id) == id {
+      return dispenser, true
+    }
+  }
+  return DispenserDetails{}, false
+}
+
+func apiControl(w http.ResponseWriter, r *http.Request, parts []string) {
+  if len(parts) != 1 {
+    apiError(w, http.StatusNotFound, "not found")
+    return
+  }
+  if _, ok := controlCommands[parts[0]]; !ok {
+    apiError(w, http.StatusNotFound, "unknown control command")
+    return
+  }
+  if !apiMethod(w, r, "POST") {
+    return
+  }
+
+  err := sendControlCommand(parts[0])
+  if err == ErrLinkDown {
+    apiError(w, http.StatusServiceUnavailable, err.Error())
+    return
+  }
+  if err != nil {
+    apiError(w, http.StatusBadGateway, err.Error())
+    return
+  }
+
+  apiWrite(w, http.StatusOK, BarbotMachine.Snapshot())
+}
+
+// apiSession handles logging in and out
+func apiSession(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+  session := getRequestSession(r)
+
+  switch r.Method {
+    case "GET":
+      if session == nil {
+        apiError(w, http.StatusUnauthorized, "not logged in")
+        return
+      }
+      apiWrite(w, http.StatusOK, ApiSession{session.Username, session.Role, session.Csrf})
+
+    case "POST":
+      var req ApiLogin
+      if !apiRead(w, r, &req) {
+        return
+      }
+      user_id, ok := authenticateUser(db, req.Username, req.Password)
+      if !ok {
+        apiError(w, http.StatusUnauthorized, "incorrect username or password")
+        return
+      }
+      session, err := startSession(db, user_id)
+      if err != nil {
+        apiError(w, http.StatusInternalServerError, err.Error())
+        return
+      }
+      setSessionCookie(w, session)
+      apiWrite(w, http.StatusOK, ApiSession{session.Username, session.Role, session.Csrf})
+
+    case "DELETE":
+      if session != nil {
+        if !csrfValid(r) {
+          apiError(w, http.StatusForbidden, "invalid or missing CSRF token")
+          return
+        }
+        endSession(db, session)
+      }
+      clearSessionCookie(w)
+      w.WriteHeader(http.StatusNoContent)
+
+    default:
+      apiMethodNotAllowed(w, "GET, POST, DELETE")
+  }
+}
+
+// apiRole checks the session has the role needed, returning 401 or 403 if not
+func apiRole(w http.ResponseWriter, r *http.Request, role string) bool {
+  session := getRequestSession(r)
+  if hasRole(session, role) {
+    return true
+  }
+  if session == nil {
+    apiError(w, http.StatusUnauthorized, "not logged in")
+  } else {
+    apiError(w, http.StatusForbidden, fmt.Sprintf("%s role needed", role))
+  }
+  return false
+}
+
+// apiMethod checks the request method, returning 405 if it's not the one expected
+func apiMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+  if r.Method != method {
+    apiMethodNotAllowed(w, method)
+    return false
+  }
+  return true
+}
+
+func apiMethodNotAllowed(w http.ResponseWriter, allowed string) {
+  w.Header().Set("Allow", allowed)
+  apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// apiRead decodes the JSON request body into v, returning 400 if it's not valid
+func apiRead(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+  err := json.NewDecoder(r.Body).Decode(v)
+  if err != nil {
+    apiError(w, http.StatusBadRequest, fmt.Sprintf("invalid request: %v", err))
+    return false
+  }
+  return true
+}
+
+func apiWrite(w http.ResponseWriter, code int, v interface{}) {
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(code)
+  err := json.NewEncoder(w).Encode(v)
+  if err != nil {
+    fmt.Printf("apiWrite: %v\n", err)
+  }
+}
+
+func apiError(w http.ResponseWriter, code int, message string) {
+  apiWrite(w, code, ApiError{message})
+}
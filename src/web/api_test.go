@@ -0,0 +1,70 @@
+package main
+
+import (
+  "context"
+  "encoding/json"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+// useTestDB runs the test against a copy of db.sqlite3, so the real one isn't changed
+func useTestDB(t *testing.T) {
+  src, err := os.Open("db.sqlite3")
+  if err != nil {
+    t.Skipf("no db.sqlite3 to test with: %v", err)
+  }
+  defer src.Close()
+
+  dir := t.TempDir()
+  dst, err := os.Create(filepath.Join(dir, "db.sqlite3"))
+  if err != nil {
+    t.Fatalf("copying db.sqlite3: %v", err)
+  }
+  _, err = io.Copy(dst, src)
+  dst.Close()
+  if err != nil {
+    t.Fatalf("copying db.sqlite3: %v", err)
+  }
+  t.Chdir(dir)
+}
+
+// apiRequest sends a request to the API as a logged in user with role, and returns the status and error message
+func apiRequest(t *testing.T, method string, path string, role string) (int, string) {
+  session := &Session{Token: "test", Csrf: "test-csrf", UserId: 1, Username: "test", Role: role}
+
+  r := httptest.NewRequest(method, path, nil)
+  r.Header.Set("X-CSRF-Token", session.Csrf)
+  r = r.WithContext(context.WithValue(r.Context(), sessionKey{}, session))
+  w := httptest.NewRecorder()
+  apiHandler(w, r)
+
+  var apiErr ApiError
+  json.Unmarshal(w.Body.Bytes(), &apiErr)
+  return w.Code, apiErr.Error
+}
+
+func TestApiUnknownOrder(t *testing.T) {
+  useTestDB(t)
+
+  tests := []struct {
+    method  string
+    path    string
+  }{
+    {"GET", "/api/v1/orders/999999"},
+    {"POST", "/api/v1/orders/999999/make"},
+    {"POST", "/api/v1/orders/999999/idcheck"},
+    {"POST", "/api/v1/orders/999999/complete"},
+    {"POST", "/api/v1/orders/999999/cancel"},
+  }
+
+  for _, test := range tests {
+    code, message := apiRequest(t, test.method, test.path, ROLE_BARTENDER)
+    if code != http.StatusNotFound {
+      t.Errorf("%s %s: got %d (%s), expected %d", test.method, test.path, code, message, http.StatusNotFound)
+    }
+  }
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+  "bufio"
+  "context"
+  "crypto/pbkdf2"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/subtle"
+  "database/sql"
+  "encoding/hex"
+  "fmt"
+  "html/template"
+  "net/http"
+  "net/url"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+)
+
+/*
+ * Logins, roles and sessions.
+ *
+ *   customer   - can order drinks (only needs to log in if run with -customer-login)
+ *   bartender  - can also use the order list (/orderlist/)
+ *   admin      - can also use the admin pages (/admin/)
+ *
+ * Logging in (/login/) starts a session, identified by a cookie. Each session also has a CSRF token,
+ * which has to be included (as the "csrf" parameter, or X-CSRF-Token header) with anything that changes
+ * state - otherwise any web page could send barbot "R" just by linking to /admin/control/reset.
+ *
+ * Users are added from the command line: go run *.go -adduser <name> -role <role>
+ */
+
+const (
+  ROLE_CUSTOMER  = "customer"
+  ROLE_BARTENDER = "bartender"
+  ROLE_ADMIN     = "admin"
+)
+
+const (
+  SESSION_COOKIE      = "barbot_session"
+  SESSION_LIFETIME    = 12 * 60 * 60  // Seconds before having to log in again
+  PASSWORD_ITERATIONS = 100000        // PBKDF2 iterations used when hashing passwords
+)
+
+// Each role can do everything the roles below it can
+var roleLevels = map[string]int{
+  ROLE_CUSTOMER:  1,
+  ROLE_BARTENDER: 2,
+  ROLE_ADMIN:     3,
+}
+
+var CustomerLoginRequired bool // Set by -customer-login
+
+type Session struct {
+  Token     string
+  Csrf      string
+  UserId    int
+  Username  string
+  Role      string
+}
+
+type LoginPage struct {
+  Next      string
+  Username  string
+  Error     string
+}
+
+type sessionKey struct{}
+
+// hasRole checks if the session is allowed to do things that need role. An empty role means anyone can.
+func hasRole(session *Session, role string) bool {
+  if role == "" || (role == ROLE_CUSTOMER && !CustomerLoginRequired) {
+    return true
+  }
+  return session != nil && roleLevels[session.Role] >= roleLevels[role]
+}
+
+// withSession looks up the session for the request (if any) and passes it on to handler, so it's
+// available from getRequestSession. Requests without a suitable role are sent to the login page.
+func withSession(role string, handler http.HandlerFunc) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    db := getDBConnection()
+    session := getSession(db, r)
+    db.Close()
+
+    if session != nil {
+      r = r.WithContext(context.WithValue(r.Context(), sessionKey{}, session))
+    }
+
+    if !hasRole(session, role) {
+      if session == nil {
+        http.Redirect(w, r, "/login/?next=" + url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+      } else {
+        http.Error(w, "You don't have permission to do that", http.StatusForbidden)
+      }
+      return
+    }
+
+    handler(w, r)
+  }
+}
+
+// getRequestSession returns the session passed on by withSession, or nil if not logged in
+func getRequestSession(r *http.Request) *Session {
+  session, _ := r.Context().Value(sessionKey{}).(*Session)
+  return session
+}
+
+// getCsrfToken returns the CSRF token to include in links and forms on a page
+func getCsrfToken(r *http.Request) string {
+  session := getRequestSession(r)
+  if session == nil {
+    return ""
+  }
+  return session.Csrf
+}
+
+// csrfValid checks the request includes the CSRF token for the session
+func csrfValid(r *http.Request) bool {
+  session := getRequestSession(r)
+  if session == nil {
+    return false
+  }
+
+  token := r.Header.Get("X-CSRF-Token")
+  if token == "" {
+    token = r.FormValue("csrf")
+  }
+  return subtle.ConstantTimeCompare([]byte(token), []byte(session.Csrf)) == 1
+}
+
+// checkCsrf returns 403 if the request doesn't have a valid CSRF token
+func checkCsrf(w http.ResponseWriter, r *http.Request) bool {
+  if !csrfValid(r) {
+    fmt.Printf("checkCsrf: rejected %s %s\n", r.Method, r.URL.Path)
+    http.Error(w, "Invalid or missing CSRF token - go back, reload the page and try again", http.StatusForbidden)
+    return false
+  }
+  return true
+}
+
+// getSession returns the session identified by the request's cookie, or nil if there isn't a current one
+func getSession(db *sql.DB, r *http.Request) *Session {
+  cookie, err := r.Cookie(SESSION_COOKIE)
+  if err != nil {
+    return nil
+  }
+
+  sqlstr := `
+    select s.token, s.csrf_token, u.id, u.username, u.role
+    from user_session s
+    inner join user_account u on u.id = s.user_id
+    where s.token = ?
+      and s.expires_ts > ?`
+
+  var session Session
+  row := db.QueryRow(sqlstr, cookie.Value, time.Now().Unix())
+  err = row.Scan(&session.Token, &session.Csrf, &session.UserId, &session.Username, &session.Role)
+  if err != nil {
+    if err != sql.ErrNoRows {
+      fmt.Printf("getSession failed: %v\n", err)
+    }
+    return nil
+  }
+  return &session
+}
+
+// startSession logs a user in, returning the new session
+func startSession(db *sql.DB, user_id int) (*Session, error) {
+  now := time.Now().Unix()
+
+  // Tidy up old sessions whilst we're here
+  _, err := db.Exec("delete from user_session where expires_ts <= ?", now)
+  if err != nil {
+    return nil, err
+  }
+
+  token, err := randomToken()
+  if err != nil {
+    return nil, err
+  }
+  csrf, err := randomToken()
+  if err != nil {
+    return nil, err
+  }
+
+  _, err = db.Exec(
+    "insert into user_session (token, csrf_token, user_id, create_ts, expires_ts) values (?, ?, ?, ?, ?)",
+    token,
+    csrf,
+    user_id,
+    now,
+    now + SESSION_LIFETIME,
+  )
+  if err != nil {
+    return nil, err
+  }
+
+  var session Session
+  row := db.QueryRow("select id, username, role from user_account where id = ?", user_id)
+  err = row.Scan(&session.UserId, &session.Username, &session.Role)
+  if err != nil {
+    return nil, err
+  }
+  session.Token = token
+  session.Csrf = csrf
+  return &session, nil
+}
+
+func setSessionCookie(w http.ResponseWriter, session *Session) {
+  http.SetCookie(w, &http.Cookie{
+    Name:     SESSION_COOKIE,
+    Value:    session.Token,
+    Path:     "/",
+    MaxAge:   SESSION_LIFETIME,
+    HttpOnly: true,
+    SameSite: http.SameSiteLaxMode,
+  })
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+  http.SetCookie(w, &http.Cookie{Name: SESSION_COOKIE, Value: "", Path: "/", MaxAge: -1})
+}
+
+// endSession logs out
+func endSession(db *sql.DB, session *Session) {
+  _, err := db.Exec("delete from user_session where token = ?", session.Token)
+  if err != nil {
+    panic(fmt.Sprintf("endSession failed: %v", err))
+  }
+}
+
+// authenticateUser checks a username and password, and returns the user_account.id
+func authenticateUser(db *sql.DB, username string, password string) (int, bool) {
+  var user_id int
+  var password_hash string
+
+  row := db.QueryRow("select id, password_hash from user_account where username = ?", username)
+  err := row.Scan(&user_id, &password_hash)
+  if err == sql.ErrNoRows {
+    // Still hash the password, so it takes as long as for a known user
+    checkPassword(password, "")
+    return 0, false
+  }
+  if err != nil {
+    panic(fmt.Sprintf("authenticateUser failed: %v", err))
+  }
+
+  if !checkPassword(password, password_hash) {
+    return 0, false
+  }
+  return user_id, true
+}
+
+// hashPassword returns a salted hash of password, in the form stored in user_account.password_hash:
+// pbkdf2-sha256$<iterations>$<salt>$<hash>
+func hashPassword(password string) (string, error) {
+  salt := make([]byte, 16)
+  _, err := rand.Read(salt)
+  if err != nil {
+    return "", err
+  }
+
+  hash, err := pbkdf2.Key(sha256.New, password, salt, PASSWORD_ITERATIONS, 32)
+  if err != nil {
+    return "", err
+  }
+  return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", PASSWORD_ITERATIONS, hex.EncodeToString(salt), hex.EncodeToString(hash)), nil
+}
+
+// checkPassword checks password against a hash from hashPassword
+func checkPassword(password string, password_hash string) bool {
+  fields := strings.Split(password_hash, "$")
+  if len(fields) != 4 || fields[0] != "pbkdf2-sha256" {
+    fields = []string{"", strconv.Itoa(PASSWORD_ITERATIONS), "", ""}
+  }
+
+  iterations, err := strconv.Atoi(fields[1])
+  if err != nil {
+    return false
+  }
+  salt, err := hex.DecodeString(fields[2])
+  if err != nil {
+    return false
+  }
+  expected, err := hex.DecodeString(fields[3])
+  if err != nil {
+    return false
+  }
+
+  hash, err := pbkdf2.Key(sha256.New, password, salt, iterations, 32)
+  if err != nil {
+    return false
+  }
+  return len(expected) > 0 && subtle.ConstantTimeCompare(hash, expected) == 1
+}
+
+func randomToken() (string, error) {
+  buf := make([]byte, 32)
+  _, err := rand.Read(buf)
+  if err != nil {
+    return "", err
+  }
+  return hex.EncodeToString(buf), nil
+}
+
+// saveUser adds a user, or changes the password and role of an existing one
+func saveUser(db *sql.DB, username string, password string, role string) error {
+  if _, ok := roleLevels[role]; !ok {
+    return fmt.Errorf("unknown role %s - should be one of %s, %s or %s", role, ROLE_CUSTOMER, ROLE_BARTENDER, ROLE_ADMIN)
+  }
+  if username == "" || password == "" {
+    return fmt.Errorf("username and password can't be blank")
+  }
+
+  password_hash, err := hashPassword(password)
+  if err != nil {
+    return err
+  }
+
+  result, err := db.Exec("update user_account set password_hash = ?, role = ? where username = ?", password_hash, role, username)
+  if err != nil {
+    return err
+  }
+  if rows, _ := result.RowsAffected(); rows > 0 {
+    // Make them log in again with the new password / role
+    _, err = db.Exec("delete from user_session where user_id = (select id from user_account where username = ?)", username)
+    return err
+  }
+
+  _, err = db.Exec(
+    "insert into user_account (username, password_hash, role, create_ts) values (?, ?, ?, ?)",
+    username,
+    password_hash,
+    role,
+    time.Now().Unix(),
+  )
+  return err
+}
+
+// addUserFromCommandLine is used for -adduser: it asks for the password on stdin, then saves the user
+func addUserFromCommandLine(username string, role string) error {
+  fmt.Printf("Password for %s: ", username)
+  reader := bufio.NewReader(os.Stdin)
+  password, err := reader.ReadString('\n')
+  if err != nil && password == "" {
+    return err
+  }
+  password = strings.TrimRight(password, "\r\n")
+
+  db := getDBConnection()
+  defer db.Close()
+
+  err = saveUser(db, username, password, role)
+  if err != nil {
+    return err
+  }
+  fmt.Printf("Saved %s (%s)\n", username, role)
+  return nil
+}
+
+// checkUsersExist warns if there's nobody who can log in to the admin pages
+func checkUsersExist() {
+  db := getDBConnection()
+  defer db.Close()
+
+  var count int
+  row := db.QueryRow("select count(*) from user_account where role = ?", ROLE_ADMIN)
+  err := row.Scan(&count)
+  if err != nil {
+    fmt.Printf("checkUsersExist: %v (run src/db/upgrade_users.sql?)\n", err)
+    return
+  }
+  if count == 0 {
+    fmt.Printf("No admin users - add one with: go run *.go -adduser <name> -role admin\n")
+  }
+}
+
+// loginHandler handles requests to /login/
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+  var page LoginPage
+  page.Next = r.FormValue("next")
+
+  // Only redirect to pages on this site
+  if !strings.HasPrefix(page.Next, "/") || strings.HasPrefix(page.Next, "//") {
+    page.Next = "/"
+  }
+
+  if r.Method == "POST" {
+    db := getDBConnection()
+    defer db.Close()
+
+    page.Username = r.FormValue("username")
+    user_id, ok := authenticateUser(db, page.Username, r.FormValue("password"))
+    if ok {
+      session, err := startSession(db, user_id)
+      if err != nil {
+        panic(fmt.Sprintf("startSession failed: %v", err))
+      }
+      fmt.Printf("loginHandler: %s logged in\n", session.Username)
+      setSessionCookie(w, session)
+      http.Redirect(w, r, page.Next, http.StatusSeeOther)
+      return
+    }
+
+    fmt.Printf("loginHandler: failed login for %s\n", page.Username)
+    page.Error = "Incorrect username or password"
+    w.WriteHeader(http.StatusUnauthorized)
+  }
+
+  t, _ := template.ParseFiles("login.html")
+  t.Execute(w, page)
+}
+
+// logoutHandler handles requests to /logout/
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+  session := getRequestSession(r)
+  if session != nil {
+    if !checkCsrf(w, r) {
+      return
+    }
+    db := getDBConnection()
+    defer db.Close()
+    endSession(db, session)
+  }
+
+  clearSessionCookie(w)
+  http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -2,6 +2,7 @@
 package main
 
 import (
+  "errors"
   "fmt"
   "html/template"
   "net/http"
@@ -9,20 +10,20 @@ import (
   _ "github.com/mattn/go-sqlite3"
   "time"
   "strings"
-  "github.com/tarm/goserial"
   "strconv"
   "flag"
-  "bufio"
+  "io/ioutil"
+  "os"
 )
 
 const ORDER_FMT = "%05d"
 
 
 type Recipe struct {
-  Id   int
-  Name string
-  Selected bool
-  Glass_type_id int
+  Id   int         `json:"id"`
+  Name string      `json:"name"`
+  Selected bool    `json:"-"`
+  Glass_type_id int `json:"-"`
 }
 
 type DrinksMenu struct {
@@ -31,32 +32,52 @@ type DrinksMenu struct {
 }
 
 type MenuItemIngredient struct {
-  Id      int
-  Name    string
-  ActQty  int
-  UoM     string
-  Manual  bool
+  Id      int     `json:"id"`
+  Name    string  `json:"name"`
+  ActQty  int     `json:"qty"`
+  UoM     string  `json:"uom"`
+  Manual  bool    `json:"manual"`
+  Qty       int   `json:"-"`  // recipe_ingredient.qty
+  UnitSize  int   `json:"-"`
+  Liquid    bool  `json:"-"`  // Measured in ml, so counts towards the volume of the drink
+  Param          int   `json:"-"`  // Dispenser parameter used to make it
+  ParamOverride  bool  `json:"-"`  // Param is set by the recipe, rather than the ingredient's default
 }
 
 type MenuItem struct {
-  Id          int
-  DrinkName   string
-  Ingredients []MenuItemIngredient
+  Id          int                   `json:"id"`
+  DrinkName   string                `json:"name"`
+  Ingredients []MenuItemIngredient  `json:"ingredients"`
+  Volume      int                   `json:"volume_ml"`
+  GlassSize   int                   `json:"glass_ml"`
+  Sizes       []string              `json:"sizes"`    // Sizes it can be ordered in
 }
 
 type OrderLogged struct {
  // Id int
   OrderId string
+  Wait    string  // Roughly how long until it's made
+  Ahead   int     // Number of drinks to be made first
+}
+
+type OrderStatusPage struct {
+  OrderRef    string
+  DrinkName   string
+  Status      string
+  Message     string
 }
 
 type OrderSent struct {
   OrderId     string
   Success     bool
   FailReason  string
+  Position    int     // Position in the dispatcher queue
+  Csrf        string
 }
 
 type OrderDetails struct {
   DrinkName   string
+  RecipeId    int
   Alcohol     bool
   Vegan       bool
   IdCheck     bool
@@ -64,18 +85,35 @@ type OrderDetails struct {
   OrderRefs   []string  // list of order refs for order selection list on left of screen
   Ingredients []MenuItemIngredient
   Glass       GlassType
+  FailReason  string
+  Status      string
+  Size        string
+  History     []OrderStatusChange
+  Preview     *DrinkPreview  // What barbot would do to make it now, if it's still to be made
+  DrinkTime   string             // Estimated time to make it
+  Waits       map[string]string  // Estimated wait for each order (by ref)
+  QueueWait   string             // Estimated time to make everything still to be made
+  Machine     MachineStatus
+  Dispatcher  DispatcherStatus
+  Alerts      []StockAlert
+  Csrf        string
 }
 
 type DispenserIngredients struct {
-  Id int
-  Name string
-  Current bool // Currently selected
+  Id int         `json:"id"`
+  Name string    `json:"name"`
+  Current bool   `json:"current"` // Currently selected
 }
 
 type DispenserDetails struct {
-  Id  int
-  Name string
-  Ingredients []DispenserIngredients
+  Id  int        `json:"id"`
+  Name string    `json:"name"`
+  Ingredients []DispenserIngredients `json:"ingredients"`
+  Tracked  bool  `json:"tracked"`  // Stock level is tracked (i.e. capacity is set)
+  Capacity int   `json:"capacity"`
+  Stock    int   `json:"stock"`
+  LowStock int   `json:"low_stock,omitempty"`  // Alert threshold, if not the default
+  UoM      string `json:"uom"`
 }
 
 type AdminRecipeIngr struct {
@@ -83,6 +121,10 @@ type AdminRecipeIngr struct {
   Name  string
   Qty   int
   UoM   string
+  RecipeQty     int     // recipe_ingredient.qty, i.e. number of measures, dashes, etc.
+  Param         string  // recipe_ingredient.dispenser_param, or blank to use the ingredient's default
+  Group         string  // recipe_ingredient.step_group, or blank
+  DefaultParam  int     // ingredient.dispenser_param
 }
 
 type GlassType struct {
@@ -99,6 +141,66 @@ type AdminRecipe struct {
   GlassTypes      []GlassType
   AllIngredients  []AdminRecipeIngr  // All known ingrediants for "Add" listbox
   RecIngredients  []AdminRecipeIngr  // Ingrediants in currently selected receipe
+  TravelInOrder   string             // Estimated time spent moving if made in recipe order, going back to 0 after
+  TravelPlanned   string             // ... and as planned by planSteps
+  TravelSaved     string
+  Volume          int                // Volume of liquid in the selected recipe (ml)
+  GlassSize       int                // Size of its glass (ml)
+  Sizes           []string           // Sizes it can be made in, for previewing
+  PreviewSize     string
+  Preview         *DrinkPreview      // Set when "Preview" is clicked
+  Error           string
+  Csrf            string
+}
+
+type AdminDispensers struct {
+  Dispensers       []DispenserDetails
+  Config           []DispenserConfig
+  Types            []DispenserType
+  MinDispenserId   int
+  MaxDispenserId   int
+  MaxRailPosition  int
+  LowStockPercent  int
+  Error            string
+  Csrf             string
+}
+
+type AdminHeader struct {
+  Link     LinkStatus
+  Machine  MachineStatus
+  Alerts   []StockAlert
+  Username string
+  Csrf     string
+}
+
+type AdminImport struct {
+  Report   *ImportReport
+  Error    string
+  Csrf     string
+}
+
+type AdminControl struct {
+  Message  string
+  Error    string
+  Machine  MachineStatus
+  Simulated    bool
+  SimGlass     bool
+  SimPosition  int
+  Dispensers   []MaintenanceDispenser
+  PrimeTime    int
+  CleanTime    int
+  Csrf         string
+}
+
+type AdminCalibrate struct {
+  Message     string
+  Error       string
+  Machine     MachineStatus
+  Status      CalibrationStatus
+  Steps       []int
+  Dispensers  []DispenserConfig
+  Saved       int   // Saved rail_position of the dispenser being calibrated, or -1
+  Csrf        string
 }
 
 
@@ -115,12 +217,20 @@ const (
 )
 
 
-var BarbotSerialChan chan []string
+var BarbotSerialChan chan BarbotRequest
+var BarbotSim *BarbotSimulator // Only set if running with -transport sim (or -dry-run)
 
 // showMenu displays the list of available drinks to the user
 func showMenu(db *sql.DB, w http.ResponseWriter) {
+      menu := DrinksMenu{"Drinks", getAvailableRecipes(db)}
+
+      t, _ := template.ParseFiles("menu.html")
+      t.Execute(w, menu)
+}
 
-      // Load drinks - only show those that can currently be made
+// getAvailableRecipes returns the drinks that can currently be made
+func getAvailableRecipes(db *sql.DB) []Recipe {
+      // Every ingredient needs to be loaded in at least one dispenser, with enough left (between them) for one drink
       rows, err := db.Query(
          `select r.id, r.name 
           from recipe r
@@ -131,10 +241,21 @@ func showMenu(db *sql.DB, w http.ResponseWriter) {
             inner join recipe_ingredient ri on r2.id = ri.recipe_id
             inner join ingredient i on i.id = ri.ingredient_id
             inner join dispenser_type dt on dt.id = i.dispenser_type_id
-            left outer join dispenser d on cast(d.ingredient_id as integer) = cast(ri.ingredient_id as integer)
-            where d.id is null 
-            and dt.manual = 0
+            where dt.manual = 0
             and r2.id = r.id
+            and not exists
+            (
+              select null
+              from dispenser d
+              where cast(d.ingredient_id as integer) = cast(ri.ingredient_id as integer)
+              and d.stock is null
+            )
+            and ifnull(
+            (
+              select sum(d.stock / dt.unit_size)
+              from dispenser d
+              where cast(d.ingredient_id as integer) = cast(ri.ingredient_id as integer)
+            ), 0) < ri.qty
           )`)
       if err != nil {
         // TODO
@@ -148,31 +269,37 @@ func showMenu(db *sql.DB, w http.ResponseWriter) {
         rows.Scan(&recipe.Id, &recipe.Name)
         recipes = append(recipes, recipe)
       }
-      rows.Close()
-
-      menu := DrinksMenu{"Drinks", recipes}
 
-      t, _ := template.ParseFiles("menu.html")
-      t.Execute(w, menu)
+      return recipes
 }
 
 // showMenuItem shows details of a  In   int // current ingrediant drink selected from the menu (ingredients, etc)
 func showMenuItem(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+      menuitem, err := getMenuItem(db, r.URL.Path[len("/menu/"):])
+      if err == sql.ErrNoRows {
+        http.NotFound(w, r)
+        return
+      }
+
+      t, _ := template.ParseFiles("menu_item.html")
+      t.Execute(w, menuitem)
+}
+
+// getMenuItem returns a recipe and its ingredients, or sql.ErrNoRows if there's no such recipe
+func getMenuItem(db *sql.DB, drink_id string) (MenuItem, error) {
       var menuitem MenuItem
-      drink_id := r.URL.Path[len("/menu/"):]
 
       // Get basic receipe information
       row := db.QueryRow("select id, name from recipe where id = ?", drink_id)
       err := row.Scan(&menuitem.Id, &menuitem.DrinkName)
-      if err == sql.ErrNoRows {
-        http.NotFound(w, r)
-        return
+      if err != nil {
+        return menuitem, err
       }
 
       menuitem.Ingredients = getRecipeIngrediants(db, drink_id)
-
-      t, _ := template.ParseFiles("menu_item.html")
-      t.Execute(w, menuitem)
+      menuitem.Volume, menuitem.GlassSize = getRecipeVolume(db, menuitem.Id)
+      menuitem.Sizes = getDrinkSizes(menuitem.Volume, menuitem.GlassSize)
+      return menuitem, nil
 }
 
 func getRecipeIngrediants(db *sql.DB, drink_id string) ([]MenuItemIngredient) {
@@ -185,12 +312,18 @@ func getRecipeIngrediants(db *sql.DB, drink_id string) ([]MenuItemIngredient) {
       i.name, 
       ri.qty * dt.unit_size as act_act, 
       case when ri.qty = 1 then dt.unit_name else dt.unit_plural end as uom,
-      dt.manual
+      dt.manual,
+      ri.qty,
+      dt.unit_size,
+      dt.unit_name = 'ml',
+      ifnull(ri.dispenser_param, i.dispenser_param),
+      ri.dispenser_param is not null
     from recipe r
     inner join recipe_ingredient ri on ri.recipe_id = r.id
     inner join ingredient i on i.id = ri.ingredient_id
     inner join dispenser_type dt on dt.id = i.dispenser_type_id
-    where r.id = ?`
+    where r.id = ?
+    order by ri.seq`
 
   rows, err := db.Query(sql, drink_id)
   if err != nil {
@@ -200,7 +333,7 @@ func getRecipeIngrediants(db *sql.DB, drink_id string) ([]MenuItemIngredient) {
 
   for rows.Next() {
     var ingr MenuItemIngredient
-    rows.Scan(&ingr.Id, &ingr.Name, &ingr.ActQty, &ingr.UoM, &ingr.Manual)
+    rows.Scan(&ingr.Id, &ingr.Name, &ingr.ActQty, &ingr.UoM, &ingr.Manual, &ingr.Qty, &ingr.UnitSize, &ingr.Liquid, &ingr.Param, &ingr.ParamOverride)
     ingrediants = append(ingrediants, ingr)
   }  
 
@@ -230,6 +363,13 @@ func adminHandler(w http.ResponseWriter, r *http.Request) {
   }
   
   req_page := r.URL.Path[len("/admin/"):]
+
+  // Anything other than just viewing a page (e.g. /admin/control/reset) changes something
+  if i := strings.Index(req_page, "/"); i >= 0 && i < len(req_page) - 1 {
+    if !checkCsrf(w, r) {
+      return
+    }
+  }
   
   switch {
     case strings.HasPrefix(req_page, "dispenser/"):
@@ -244,6 +384,14 @@ func adminHandler(w http.ResponseWriter, r *http.Request) {
       adminControl(w, r, req_page[len("control/"):])
       return;
 
+    case strings.HasPrefix(req_page, "calibrate/"):
+      adminCalibrate(w, r, req_page[len("calibrate/"):])
+      return;
+
+    case strings.HasPrefix(req_page, "import/"):
+      adminImport(w, r, req_page[len("import/"):])
+      return;
+
     default:
       http.NotFound(w, r)
       return
@@ -251,10 +399,23 @@ func adminHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 
+// getAdminHeader returns the details shown at the top of every admin page
+func getAdminHeader(r *http.Request) AdminHeader {
+  header := AdminHeader{Link: BarbotLink.Snapshot(), Machine: BarbotMachine.Snapshot(), Csrf: getCsrfToken(r)}
+  if session := getRequestSession(r); session != nil {
+    header.Username = session.Username
+  }
+
+  db := getDBConnection()
+  defer db.Close()
+  header.Alerts = getStockAlerts(db)
+  return header
+}
+
 // adminRecipe allows a recipe to be added / amended
 func adminRecipe(w http.ResponseWriter, r *http.Request, param string) {
 
-  tmpl, _ := template.ParseFiles("admin_header.html", "admin_recipe.html", "admin_footer.html")
+  tmpl, _ := template.ParseFiles("admin_header.html", "admin_recipe.html", "drink_preview.html", "admin_footer.html")
 
   // Open database
   db := getDBConnection()
@@ -297,6 +458,7 @@ func adminRecipe(w http.ResponseWriter, r *http.Request, param string) {
     // return
   }
   
+  var recipe_error string
   if (param == "add_ingrediant") {
     // returned form is wanting to add an ingrediant to a drink
 // NSERT INTO recipe_ingredient (recipe_id, ingredient_id, seq, qty) SELECT r.id, i.id, 4, 1 FROM recipe r, ingredient i WHERE r.name = 'Gin and tonic (lemon lime)' AND i.name = 'Lemon'; 
@@ -335,17 +497,143 @@ func adminRecipe(w http.ResponseWriter, r *http.Request, param string) {
         seq_num = 1
       }
         
-      
-      _, err = db.Exec("insert into recipe_ingredient (recipe_id, ingredient_id, seq, qty) values (?, ?, ?, ?)", recipe_id, ingredient_id, seq_num, ingredient_qty)
-      if err != nil {
-        panic(fmt.Sprintf("Failed to update db (add ingrediant): %v", err))
+      // Don't allow more than will fit in the glass
+      volume, glass_ml := getRecipeVolume(db, recipe_id)
+      add_ml := getIngredientVolume(db, ingredient_id, ingredient_qty)
+      if glass_ml > 0 && add_ml > 0 && volume + add_ml > glass_ml {
+        recipe_error = fmt.Sprintf("Not added - that would make %dml, but the glass only holds %dml", volume + add_ml, glass_ml)
+      } else {
+        _, err = db.Exec("insert into recipe_ingredient (recipe_id, ingredient_id, seq, qty) values (?, ?, ?, ?)", recipe_id, ingredient_id, seq_num, ingredient_qty)
+        if err != nil {
+          panic(fmt.Sprintf("Failed to update db (add ingrediant): %v", err))
+        }
       }
     }
     //  http.Redirect(w, r, "/admin/recipe/", http.StatusSeeOther)
   //   return
   }
   
+  if (param == "save") {
+    // returned form is qty_<ingredient_id>=<quantity>, param_<ingredient_id>=<dispenser param> (blank
+    // to use the ingredient's default) and group_<ingredient_id>=<step group> (blank for none)
+    qtys := make(map[int]int)
+    for field := range r.PostForm {
+      if strings.HasPrefix(field, "qty_") {
+        ingredient_id, err := strconv.Atoi(field[len("qty_"):])
+        if err != nil {
+          continue
+        }
+        qty, err := strconv.Atoi(strings.TrimSpace(r.PostForm.Get(field)))
+        if err != nil || qty <= 0 {
+          recipe_error = fmt.Sprintf("Invalid quantity: %s", r.PostForm.Get(field))
+          continue
+        }
+        qtys[ingredient_id] = qty
+        continue
+      }
+
+      if strings.HasPrefix(field, "group_") {
+        ingredient_id, err := strconv.Atoi(field[len("group_"):])
+        if err != nil {
+          continue
+        }
+        var step_group interface{}
+        if value := strings.TrimSpace(r.PostForm.Get(field)); value != "" {
+          group_val, err := strconv.Atoi(value)
+          if err != nil || group_val <= 0 {
+            recipe_error = fmt.Sprintf("Invalid group: %s", value)
+            continue
+          }
+          step_group = group_val
+        }
+        _, err = db.Exec("update recipe_ingredient set step_group=? where recipe_id=? and ingredient_id=?", step_group, recipe_id, ingredient_id)
+        if err != nil {
+          panic(fmt.Sprintf("Failed to update db (set group): %v", err))
+        }
+        continue
+      }
+
+      if !strings.HasPrefix(field, "param_") {
+        continue
+      }
+      ingredient_id, err := strconv.Atoi(field[len("param_"):])
+      if err != nil {
+        continue
+      }
+
+      var dispenser_param interface{}
+      if value := strings.TrimSpace(r.PostForm.Get(field)); value != "" {
+        param_val, err := strconv.Atoi(value)
+        if err != nil || param_val < 0 {
+          recipe_error = fmt.Sprintf("Invalid dispenser parameter: %s", value)
+          continue
+        }
+        dispenser_param = param_val
+      }
+
+      _, err = db.Exec("update recipe_ingredient set dispenser_param=? where recipe_id=? and ingredient_id=?", dispenser_param, recipe_id, ingredient_id)
+      if err != nil {
+        panic(fmt.Sprintf("Failed to update db (set params): %v", err))
+      }
+    }
+
+    if err := setRecipeQuantities(db, recipe_id, qtys); err != nil {
+      recipe_error = err.Error()
+    }
+  }
+  
+  if (param == "move") {
+    // returned form is move_up=<ingredient_id> or move_down=<ingredient_id>
+    ingredient_id, err := strconv.Atoi(r.Form.Get("move_up"))
+    up := err == nil
+    if !up {
+      ingredient_id, err = strconv.Atoi(r.Form.Get("move_down"))
+    }
+    if err == nil {
+      err = moveRecipeIngredient(db, recipe_id, ingredient_id, up)
+      if err != nil {
+        panic(fmt.Sprintf("Failed to update db (move ingrediant): %v", err))
+      }
+    }
+  }
+  
+  if (param == "rename_drink") {
+    // returned form is recipe_name=<new name>, glass_selection=<glass_type_id>
+    glass_type_id, err := strconv.Atoi(r.Form.Get("glass_selection"))
+    if err != nil {
+      http.Redirect(w, r, "/admin/recipe/", http.StatusSeeOther)
+      return
+    }
+    err = renameRecipe(db, recipe_id, r.Form.Get("recipe_name"), glass_type_id)
+    if err != nil {
+      recipe_error = err.Error()
+    }
+  }
+  
+  if (param == "clone_drink") {
+    // returned form is clone_name=<name for the copy>, blank for "<name> (copy)"
+    new_id, err := cloneRecipe(db, recipe_id, r.Form.Get("clone_name"))
+    if err != nil {
+      recipe_error = err.Error()
+    } else {
+      recipe_id = new_id
+    }
+  }
+  
+  if (param == "delete_drink") {
+    err = deleteRecipe(db, recipe_id)
+    if err == ErrRecipeInUse {
+      recipe_error = err.Error()
+    } else if err != nil {
+      panic(fmt.Sprintf("Failed to update db (delete recipe): %v", err))
+    } else {
+      recipe_id = -1
+    }
+  }
+  
   var adminR AdminRecipe 
+  adminR.Csrf = getCsrfToken(r)
+  adminR.Error = recipe_error
   
   
   if (recipe_id > 0) {
@@ -368,6 +656,7 @@ func adminRecipe(w http.ResponseWriter, r *http.Request, param string) {
     rows.Scan(&recipe.Id, &recipe.Name, &tmp_glass_type_id)
     if recipe_id == recipe.Id {
       recipe.Selected = true
+      adminR.RecipieName = recipe.Name
       glass_type_id = tmp_glass_type_id
     } else {
       recipe.Selected = false
@@ -417,7 +706,11 @@ func adminRecipe(w http.ResponseWriter, r *http.Request, param string) {
           i.id,  
           i.name,
           ri.qty * dt.unit_size,
-          case when ri.qty = 1 then dt.unit_name else dt.unit_plural end as uom
+          case when ri.qty = 1 then dt.unit_name else dt.unit_plural end as uom,
+          ifnull(ri.dispenser_param, ''),
+          i.dispenser_param,
+          ri.qty,
+          ifnull(ri.step_group, '')
         from recipe_ingredient ri
         inner join ingredient i on ri.ingredient_id = i.id
         inner join dispenser_type dt on dt.id = i.dispenser_type_id
@@ -432,14 +725,38 @@ func adminRecipe(w http.ResponseWriter, r *http.Request, param string) {
 
   for rows.Next() {
     var recipeIngr AdminRecipeIngr
-    rows.Scan(&recipeIngr.Id, &recipeIngr.Name, &recipeIngr.Qty, &recipeIngr.UoM)
+    rows.Scan(&recipeIngr.Id, &recipeIngr.Name, &recipeIngr.Qty, &recipeIngr.UoM, &recipeIngr.Param, &recipeIngr.DefaultParam, &recipeIngr.RecipeQty, &recipeIngr.Group)
     adminR.RecIngredients = append(adminR.RecIngredients, recipeIngr)
   }
   rows.Close()
-   
+  
+  if recipe_id > 0 {
+    adminR.Volume, adminR.GlassSize = getRecipeVolume(db, recipe_id)
+
+    // Travel time, as made in recipe order vs planned (both starting from 0)
+    steps, _, _, err := getRecipeSteps(db, recipe_id, 1, 0, true)
+    if err == nil {
+      in_order := travelTime(steps, 0, 0)
+      planned, park := planSteps(steps, 0)
+      planned_time := travelTime(planned, 0, park)
+      adminR.TravelInOrder = fmt.Sprintf("%.1fs", in_order.Seconds())
+      adminR.TravelPlanned = fmt.Sprintf("%.1fs", planned_time.Seconds())
+      adminR.TravelSaved = fmt.Sprintf("%.1fs", (in_order - planned_time).Seconds())
+    }
+
+    adminR.Sizes = getDrinkSizes(adminR.Volume, adminR.GlassSize)
+    adminR.PreviewSize = SIZE_SINGLE
+    if param == "preview" {
+      if size := r.Form.Get("size"); size != "" {
+        adminR.PreviewSize = size
+      }
+      preview := previewDrink(db, recipe_id, adminR.PreviewSize)
+      adminR.Preview = &preview
+    }
+  }
 
   
-  tmpl.ExecuteTemplate(w, "admin_header", nil)
+  tmpl.ExecuteTemplate(w, "admin_header", getAdminHeader(r))
   tmpl.ExecuteTemplate(w, "admin_recipe", adminR)
   tmpl.ExecuteTemplate(w, "admin_footer", nil)
   return
@@ -459,12 +776,11 @@ func adminDispenser(w http.ResponseWriter, r *http.Request, param string) {
     // returned form is dispenser_id=ingredient_id
     r.ParseForm()
 
-    for dispenser_id, ingredient_id := range r.Form {
-      _, err := db.Exec(
-              "update dispenser set ingredient_id = ? where id = ?",
-              ingredient_id[0],
-              dispenser_id,
-      )
+    for dispenser_id, ingredient_id := range r.PostForm {
+      if dispenser_id == "csrf" {
+        continue
+      }
+      err := setDispenserIngredient(db, dispenser_id, ingredient_id[0])
       if err != nil {
         panic(fmt.Sprintf("Failed to update db: %v", err))
       }
@@ -475,16 +791,131 @@ func adminDispenser(w http.ResponseWriter, r *http.Request, param string) {
     return
   }
 
-  var dispensers = make([]DispenserDetails,21) // TODO: Do not hard code number of dispenersers...
+  if (param == "stock") {
+    // returned form is dispenser_id, capacity, stock and low_stock
+    capacity, _ := strconv.Atoi(r.FormValue("capacity"))
+    low_stock, _ := strconv.Atoi(r.FormValue("low_stock"))
+    stock, err := strconv.Atoi(r.FormValue("stock"))
+    if err != nil {
+      stock = capacity
+    }
+
+    err = setDispenserStock(db, r.FormValue("dispenser_id"), capacity, stock, low_stock)
+    if err != nil {
+      panic(fmt.Sprintf("Failed to update db: %v", err))
+    }
+
+    http.Redirect(w, r, "/admin/dispenser/", http.StatusSeeOther)
+    return
+  }
+
+  if strings.HasPrefix(param, "restock/") {
+    err := restockDispenser(db, param[len("restock/"):])
+    if err != nil {
+      panic(fmt.Sprintf("Failed to update db: %v", err))
+    }
+
+    http.Redirect(w, r, "/admin/dispenser/", http.StatusSeeOther)
+    return
+  }
+
+  var dispenser_error string
+  if strings.HasPrefix(param, "remove/") {
+    dispenser_id, err := strconv.Atoi(param[len("remove/"):])
+    if err == nil {
+      err = removeDispenser(db, dispenser_id)
+      if err != nil {
+        dispenser_error = err.Error()
+      }
+    }
+
+    if dispenser_error == "" {
+      http.Redirect(w, r, "/admin/dispenser/", http.StatusSeeOther)
+      return
+    }
+  }
+  if (param == "add" || param == "config") {
+    // returned form is dispenser_id, type_id, name and rail_position
+    dispenser_id, err1 := strconv.Atoi(r.FormValue("dispenser_id"))
+    type_id, err2 := strconv.Atoi(r.FormValue("type_id"))
+    rail_position, err3 := strconv.Atoi(r.FormValue("rail_position"))
+
+    var err error
+    if err1 != nil || err2 != nil || err3 != nil {
+      err = fmt.Errorf("Dispenser id, type and rail position are all needed")
+    } else if param == "add" {
+      err = addDispenser(db, dispenser_id, type_id, r.FormValue("name"), rail_position)
+    } else {
+      err = updateDispenser(db, dispenser_id, type_id, r.FormValue("name"), rail_position)
+    }
+
+    if err == nil {
+      http.Redirect(w, r, "/admin/dispenser/", http.StatusSeeOther)
+      return
+    }
+    dispenser_error = err.Error()
+  }
+
+  adminD := AdminDispensers{
+    Dispensers:      getDispensers(db),
+    Config:          getDispenserConfig(db),
+    Types:           getDispenserTypes(db),
+    MinDispenserId:  BarbotProfile.MinDispenserId,
+    MaxDispenserId:  BarbotProfile.DispenserCount - 1,
+    MaxRailPosition: MAX_RAIL_POSITION,
+    LowStockPercent: LowStockPercent,
+    Error:           dispenser_error,
+    Csrf:            getCsrfToken(r),
+  }
+
+  tmpl.ExecuteTemplate(w, "admin_header", getAdminHeader(r))
+  tmpl.ExecuteTemplate(w, "admin_dispenser", adminD)
+  tmpl.ExecuteTemplate(w, "admin_footer", nil)
+  return
+}
+
+// setDispenserIngredient changes the ingredient loaded in a dispenser. If it's different to what was
+// there before, it's assumed to be a full bottle.
+func setDispenserIngredient(db *sql.DB, dispenser_id string, ingredient_id string) error {
+  if ingredient_id == "" {
+    // Emptied
+    _, err := db.Exec("update dispenser set ingredient_id = null where id = ?", dispenser_id)
+    return err
+  }
+
+  _, err := db.Exec(
+          "update dispenser set stock = capacity where id = ? and ifnull(ingredient_id, -1) != ?",
+          dispenser_id,
+          ingredient_id,
+  )
+  if err != nil {
+    return err
+  }
+
+  _, err = db.Exec(
+          "update dispenser set ingredient_id = ? where id = ?",
+          ingredient_id,
+          dispenser_id,
+  )
+  return err
+}
+
+// getDispensers returns all (non-manual) dispensers, in id order, along with the ingredients that could be loaded in each
+func getDispensers(db *sql.DB) []DispenserDetails {
+  dispensers := []DispenserDetails{}
 
   // Get a list of all dispensers, possible ingrediants and current ingrediant
   sql := `
     select
       d.id as dispenser_id,
-      d.name as dispenser_name,
+      ifnull(d.name, 'Dispenser ' || d.id) as dispenser_name,
       case when d.ingredient_id = i.id then 1 else 0 end as current,
-      i.id as ingredient_id,
-      i.name as ingredient_name
+      ifnull(i.id, 0) as ingredient_id,
+      ifnull(i.name, '') as ingredient_name,
+      ifnull(d.capacity, 0),
+      ifnull(d.stock, 0),
+      ifnull(d.low_stock, 0),
+      dt.unit_plural
     from dispenser d 
     inner join dispenser_type dt on dt.id = d.dispenser_type_id
     left outer join ingredient i on d.dispenser_type_id = i.dispenser_type_id
@@ -504,22 +935,36 @@ func adminDispenser(w http.ResponseWriter, r *http.Request, param string) {
     var dispenser_id int
     var dispenser_name string
     var current int
+    var capacity int
+    var stock int
+    var low_stock int
+    var uom string
       
-    rows.Scan(&dispenser_id, &dispenser_name, &current, &ingr.Id, &ingr.Name)
+    rows.Scan(&dispenser_id, &dispenser_name, &current, &ingr.Id, &ingr.Name, &capacity, &stock, &low_stock, &uom)
     if current==1 {
       ingr.Current = true
     } else {
       ingr.Current = false
     }
-    dispensers[dispenser_id].Ingredients = append(dispensers[dispenser_id].Ingredients, ingr)
-    dispensers[dispenser_id].Name = dispenser_name
-    dispensers[dispenser_id].Id = dispenser_id
+    if len(dispensers) == 0 || dispensers[len(dispensers)-1].Id != dispenser_id {
+      dispensers = append(dispensers, DispenserDetails{
+        Id:       dispenser_id,
+        Name:     dispenser_name,
+        Ingredients: []DispenserIngredients{},
+        Tracked:  capacity > 0,
+        Capacity: capacity,
+        Stock:    stock,
+        LowStock: low_stock,
+        UoM:      uom,
+      })
+    }
+    if ingr.Id > 0 {
+      dispenser := &dispensers[len(dispensers)-1]
+      dispenser.Ingredients = append(dispenser.Ingredients, ingr)
+    }
   }
-  
-  tmpl.ExecuteTemplate(w, "admin_header", nil)
-  tmpl.ExecuteTemplate(w, "admin_dispenser", dispensers)
-  tmpl.ExecuteTemplate(w, "admin_footer", nil)
-  return
+
+  return dispensers
 }
 
 func adminControl(w http.ResponseWriter, r *http.Request, param string) {
@@ -529,31 +974,212 @@ func adminControl(w http.ResponseWriter, r *http.Request, param string) {
   db := getDBConnection()
   defer db.Close()
 
-  sendmsg := true
-  
-  cmdlist := make([]string, 1)
-  
+  var status AdminControl
+
+  var cmdList []string
+  var err error
+
   switch (param) {
-    case "reset":
-      cmdlist[0] = "R"
-      
-    case "zero":
-      cmdlist[0] = "Z"
-      
-    default:
-      sendmsg = false
+    case "sim_glass_remove", "sim_glass_place":
+      if BarbotSim != nil {
+        BarbotSim.SetGlassPresent(param == "sim_glass_place")
+      }
+
+    case "fire":
+      // returned form is dispenser_id, param (blank for the dispenser's default)
+      dispenser_id, _ := strconv.Atoi(r.FormValue("dispenser_id"))
+      fire_param, perr := strconv.Atoi(strings.TrimSpace(r.FormValue("param")))
+      if perr != nil {
+        fire_param = -1
+      }
+      cmdList, err = getTestFireCommands(db, dispenser_id, fire_param)
+
+    case "prime":
+      ms, _ := strconv.Atoi(r.FormValue("ms"))
+      cmdList, err = getPrimeCommands(db, ms)
+
+    case "clean":
+      ms, _ := strconv.Atoi(r.FormValue("ms"))
+      cmdList, err = getCleaningCommands(db, ms)
+  }
+
+  if err == nil && cmdList != nil {
+    err = sendMaintenanceCommands(cmdList)
+    if err == nil {
+      status.Message = fmt.Sprintf("Sent %s: %s", param, strings.Join(cmdList, ", "))
+    }
+  }
+  if err != nil {
+    status.Error = err.Error()
   }
 
-  if (sendmsg) {
-    BarbotSerialChan <- cmdlist
+  if _, ok := controlCommands[param]; ok {
+    err := sendControlCommand(param)
+    if err != nil {
+      status.Error = err.Error()
+    } else {
+      status.Message = fmt.Sprintf("Sent %s", param)
+    }
+  }
+
+  status.Machine = BarbotMachine.Snapshot()
+  status.Dispensers = getMaintenanceDispensers(db)
+  status.PrimeTime = PRIME_MIXER_TIME
+  status.CleanTime = CLEAN_TIME
+  status.Csrf = getCsrfToken(r)
+  if BarbotSim != nil {
+    status.Simulated = true
+    status.SimGlass = BarbotSim.GlassPresent()
+    status.SimPosition = BarbotSim.Position()
   }
 
-  tmpl.ExecuteTemplate(w, "admin_header" , nil)
-  tmpl.ExecuteTemplate(w, "admin_control", nil)
+  tmpl.ExecuteTemplate(w, "admin_header", getAdminHeader(r))
+  tmpl.ExecuteTemplate(w, "admin_control", status)
   tmpl.ExecuteTemplate(w, "admin_footer" , nil)
   return
 }
 
+// adminCalibrate handles the rail calibration page
+func adminCalibrate(w http.ResponseWriter, r *http.Request, param string) {
+  tmpl, _ := template.ParseFiles("admin_header.html", "admin_calibrate.html", "admin_footer.html")
+
+  // Open database
+  db := getDBConnection()
+  defer db.Close()
+
+  var page AdminCalibrate
+  var err error
+
+  switch (param) {
+    case "start":
+      err = BarbotCalibration.Start()
+
+    case "finish":
+      BarbotCalibration.Finish()
+      page.Message = "Calibration finished"
+
+    case "zero":
+      err = BarbotCalibration.Zero()
+
+    case "jog":
+      // returned form is step=<steps per click>, dir=-1 or 1
+      step, _ := strconv.Atoi(r.FormValue("step"))
+      BarbotCalibration.SetStep(step)
+      dir, _ := strconv.Atoi(r.FormValue("dir"))
+      err = BarbotCalibration.Jog(dir)
+
+    case "goto":
+      dispenser_id, _ := strconv.Atoi(r.FormValue("dispenser_id"))
+      err = BarbotCalibration.GotoDispenser(db, dispenser_id)
+
+    case "select":
+      dispenser_id, _ := strconv.Atoi(r.FormValue("dispenser_id"))
+      BarbotCalibration.SetDispenser(dispenser_id)
+
+    case "save":
+      err = BarbotCalibration.Save(db)
+      if err == nil {
+        status := BarbotCalibration.Snapshot()
+        page.Message = fmt.Sprintf("Saved %d as dispenser %d's rail position", status.Position, status.Dispenser)
+      }
+
+    case "verify":
+      err = BarbotCalibration.StartVerify(db)
+
+    case "next":
+      err = BarbotCalibration.NextVerify(db)
+      if err == nil && !BarbotCalibration.Snapshot().Verifying {
+        page.Message = "All dispensers verified"
+      }
+  }
+  if err != nil {
+    page.Error = err.Error()
+  }
+
+  page.Machine = BarbotMachine.Snapshot()
+  page.Status = BarbotCalibration.Snapshot()
+  page.Steps = CALIBRATION_STEPS
+  page.Dispensers = getDispenserConfig(db)
+  page.Saved = -1
+  for _, dispenser := range page.Dispensers {
+    if dispenser.Id == page.Status.Dispenser {
+      page.Saved = dispenser.RailPosition
+    }
+  }
+  page.Csrf = getCsrfToken(r)
+
+  tmpl.ExecuteTemplate(w, "admin_header", getAdminHeader(r))
+  tmpl.ExecuteTemplate(w, "admin_calibrate", page)
+  tmpl.ExecuteTemplate(w, "admin_footer" , nil)
+}
+
+// adminImport handles importing and exporting recipes
+func adminImport(w http.ResponseWriter, r *http.Request, param string) {
+  tmpl, _ := template.ParseFiles("admin_header.html", "admin_import.html", "admin_footer.html")
+
+  // Open database
+  db := getDBConnection()
+  defer db.Close()
+
+  var page AdminImport
+  page.Csrf = getCsrfToken(r)
+
+  switch (param) {
+    case "export":
+      format := r.FormValue("format")
+      data, err := encodeRecipes(exportRecipes(db), format)
+      if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+      }
+      w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=recipes.%s", format))
+      w.Write(data)
+      return
+
+    case "import":
+      upload, _, err := r.FormFile("recipes")
+      if err != nil {
+        page.Error = "Choose a file to import"
+        break
+      }
+      defer upload.Close()
+
+      data, err := ioutil.ReadAll(upload)
+      if err != nil {
+        page.Error = err.Error()
+        break
+      }
+
+      file, err := decodeRecipes(data)
+      if err != nil {
+        page.Error = fmt.Sprintf("Failed to read file: %v", err)
+        break
+      }
+
+      report := importRecipes(db, file, r.FormValue("dry_run") != "")
+      page.Report = &report
+  }
+
+  tmpl.ExecuteTemplate(w, "admin_header", getAdminHeader(r))
+  tmpl.ExecuteTemplate(w, "admin_import", page)
+  tmpl.ExecuteTemplate(w, "admin_footer" , nil)
+}
+
+// Instructions sent by the buttons on the control page
+var controlCommands = map[string]string{
+  "reset": "R",
+  "zero":  "Z",
+}
+
+// sendControlCommand sends one of controlCommands to barbot
+func sendControlCommand(param string) error {
+  cmd, ok := controlCommands[param]
+  if !ok {
+    return fmt.Errorf("unknown control command: %s", param)
+  }
+  return sendCommands([]string{cmd})
+}
+
 
 // orderListHandler handles requests to /orderlist/
 func orderListHandler(w http.ResponseWriter, r *http.Request) {
@@ -563,19 +1189,8 @@ func orderListHandler(w http.ResponseWriter, r *http.Request) {
     defer db.Close()
 
 
-    sqlstr := "select id from drink_order where cancelled = 0 and made_end_ts is null"
-
-    rows, err := db.Query(sqlstr)
-    if err != nil {
-      // TODO
-      panic(fmt.Sprintf("%v", err))
-    }
-    defer rows.Close()
-
     var orderdetails OrderDetails
-    for rows.Next() {
-      var id int
-      rows.Scan(&id)
+    for _, id := range getActiveOrders(db) {
       orderdetails.OrderRefs = append(orderdetails.OrderRefs, fmt.Sprintf(ORDER_FMT, id))
     }
 
@@ -583,6 +1198,12 @@ func orderListHandler(w http.ResponseWriter, r *http.Request) {
 
       // Check if user has clicked on a on order
       var p string = r.URL.Path[len("/orderlist/"):] 
+
+      // Everything other than viewing an order changes something
+      if strings.Contains(p, "/") && !checkCsrf(w, r) {
+        return
+      }
+
       switch  {
         case strings.HasPrefix(p, "remove/"):
           removeOrder(db, w, r, p[len("remove/"):])
@@ -595,6 +1216,15 @@ func orderListHandler(w http.ResponseWriter, r *http.Request) {
           }
           return
           
+        case strings.HasPrefix(p, "idcheck/"):
+          checkOrderId(db, w, r, p[len("idcheck/"):])
+          return
+
+        case strings.HasPrefix(p, "auto/"):
+          BarbotDispatcher.SetAutoAdvance(p[len("auto/"):] == "on")
+          http.Redirect(w, r, "/orderlist/", http.StatusSeeOther)
+          return
+
         case strings.HasPrefix(p, "complete/"):
           if !completeOrder(db, w, r, p[len("complete/"):]) {
             http.NotFound(w, r)
@@ -603,57 +1233,162 @@ func orderListHandler(w http.ResponseWriter, r *http.Request) {
       }
 
       // Assume order ref passed in (->404 if not), so also get the details of that order
-      orderdetails.OrderRef = r.URL.Path[len("/orderlist/"):]
-
-      sqlstr = `
-        select
-          do.alcohol,
-          do.id_checked,
-          r.name,
-          do.recipe_id,
-          gt.id,
-          gt.name
-        from drink_order do
-        inner join recipe r on do.recipe_id = r.id
-        inner join glass_type gt on r.glass_type_id = gt.id
-        where do.id = ?`
-
-      row := db.QueryRow(sqlstr, orderdetails.OrderRef)
-      var recipe_id string
-      err := row.Scan(&orderdetails.Alcohol, &orderdetails.IdCheck, &orderdetails.DrinkName, &recipe_id, &orderdetails.Glass.Id, &orderdetails.Glass.Name)
+      drink_order_id, err := strconv.Atoi(p)
+      if err != nil {
+        http.NotFound(w, r)
+        return
+      }
+
+      order_refs := orderdetails.OrderRefs
+      orderdetails, err = getOrderDetails(db, drink_order_id)
       if err == sql.ErrNoRows {
         http.NotFound(w, r)
         return
-      } else {
-        if err != nil {
-          panic(fmt.Sprintf("orderListHandler - failed to get order details: %#v", err))
-        }
       }
-      
-      // Get list of ingrediants
-      orderdetails.Ingredients = getRecipeIngrediants(db, recipe_id)
+      orderdetails.OrderRefs = order_refs
+
+      // Show what barbot would be sent, if it's still to be made
+      if orderdetails.Status != ORDER_DONE && orderdetails.Status != ORDER_CANCELLED {
+        preview := previewDrink(db, orderdetails.RecipeId, orderdetails.Size)
+        orderdetails.Preview = &preview
+      }
     }
 
-    t, _ := template.ParseFiles("order_list.html")
+    // How long everything's going to take
+    orderdetails.Waits = make(map[string]string)
+    var queue_wait time.Duration
+    for id, estimate := range estimateOrders(db) {
+      ref := fmt.Sprintf(ORDER_FMT, id)
+      orderdetails.Waits[ref] = formatWait(estimate.Wait)
+      if ref == orderdetails.OrderRef {
+        orderdetails.DrinkTime = formatSeconds(estimate.Drink)
+      }
+      if estimate.Wait > queue_wait {
+        queue_wait = estimate.Wait
+      }
+    }
+    if queue_wait > 0 {
+      orderdetails.QueueWait = formatWait(queue_wait)
+    }
+
+    orderdetails.Machine = BarbotMachine.Snapshot()
+    orderdetails.Dispatcher = BarbotDispatcher.Status()
+    orderdetails.Alerts = getStockAlerts(db)
+    orderdetails.Csrf = getCsrfToken(r)
+
+    t, _ := template.ParseFiles("order_list.html", "drink_preview.html")
     t.Execute(w, orderdetails)
 
 }
 
+// getActiveOrders returns the ids of all orders that haven't been finished or cancelled, oldest first
+func getActiveOrders(db *sql.DB) []int {
+  var ids []int
+
+  sqlstr := "select id from drink_order where status not in (?, ?) order by id"
+
+  rows, err := db.Query(sqlstr, ORDER_DONE, ORDER_CANCELLED)
+  if err != nil {
+    // TODO
+    panic(fmt.Sprintf("%v", err))
+  }
+  defer rows.Close()
+
+  for rows.Next() {
+    var id int
+    rows.Scan(&id)
+    ids = append(ids, id)
+  }
+
+  return ids
+}
+
+// getOrderDetails returns the details of an order, or sql.ErrNoRows if there's no such order
+func getOrderDetails(db *sql.DB, drink_order_id int) (OrderDetails, error) {
+  var orderdetails OrderDetails
+
+  sqlstr := `
+    select
+      do.alcohol,
+      do.id_checked,
+      ifnull(do.fail_reason, ''),
+      do.status,
+      do.size,
+      r.name,
+      do.recipe_id,
+      gt.id,
+      gt.name
+    from drink_order do
+    inner join recipe r on do.recipe_id = r.id
+    inner join glass_type gt on r.glass_type_id = gt.id
+    where do.id = ?`
+
+  row := db.QueryRow(sqlstr, drink_order_id)
+  var recipe_id int
+  err := row.Scan(&orderdetails.Alcohol, &orderdetails.IdCheck, &orderdetails.FailReason, &orderdetails.Status, &orderdetails.Size, &orderdetails.DrinkName, &recipe_id, &orderdetails.Glass.Id, &orderdetails.Glass.Name)
+  if err == sql.ErrNoRows {
+    return orderdetails, err
+  }
+  if err != nil {
+    panic(fmt.Sprintf("getOrderDetails - failed to get order details: %#v", err))
+  }
+  orderdetails.OrderRef = fmt.Sprintf(ORDER_FMT, drink_order_id)
+  orderdetails.RecipeId = recipe_id
+
+  // Get list of ingrediants, in the quantities needed for the size ordered
+  orderdetails.Ingredients = getRecipeIngrediants(db, strconv.Itoa(recipe_id))
+  volume, glass_ml := getRecipeVolume(db, recipe_id)
+  if scale, err := sizeScale(orderdetails.Size, volume, glass_ml); err == nil {
+    scaleIngredients(orderdetails.Ingredients, scale)
+  }
+
+  orderdetails.History = getOrderHistory(db, drink_order_id)
+  return orderdetails, nil
+}
+
 // removeOrder is called when an order is selected and "remove" clicked. In reality it actaully cancels, not deletes, it.
 func removeOrder(db *sql.DB, w http.ResponseWriter, r *http.Request, p string) bool {
   
-  sqlstr := `
-    update drink_order 
-    set cancelled = ?
-    where id = ?
-      and made_end_ts is null`
-      
-  _, err := db.Exec(sqlstr, true, p)
+  drink_order_id, err := strconv.Atoi(p)
+  if err != nil {
+    return false
+  }
+  
+  err = cancelOrder(db, drink_order_id)
+  if err != nil {
+    fmt.Printf("removeOrder: %v\n", err)
+    return false
+  }
+  
+  return true
+}
 
+// cancelOrder cancels an order, taking it out of the dispatcher queue if it's in there
+func cancelOrder(db *sql.DB, drink_order_id int) error {
+  err := setOrderStatus(db, drink_order_id, ORDER_CANCELLED, "")
+  if err != nil {
+    return err
+  }
+
+  BarbotDispatcher.Remove(drink_order_id)
+  return nil
+}
+
+// checkOrderId is called when the bartender has checked the customer's ID for an alcoholic drink
+func checkOrderId(db *sql.DB, w http.ResponseWriter, r *http.Request, p string) {
+  
+  drink_order_id, err := strconv.Atoi(p)
+  if err != nil {
+    http.NotFound(w, r)
+    return
+  }
+  
+  err = setOrderStatus(db, drink_order_id, ORDER_QUEUED, "ID checked")
   if err != nil {
-    panic(fmt.Sprintf("removeOrder failed: %#v", err))
+    fmt.Printf("checkOrderId: %v\n", err)
   }
-  return false
+  
+  http.Redirect(w, r, "/orderlist/" + p, http.StatusSeeOther)
 }
 
 
@@ -666,39 +1401,55 @@ func makeOrder(db *sql.DB, w http.ResponseWriter, r *http.Request, p string) boo
   } 
   
   details.OrderId = fmt.Sprintf(ORDER_FMT, drink_order_id)
+  details.Csrf = getCsrfToken(r)
   
-  // Generate command list. This will fail if not all the ingrediants are present
-  fmt.Printf("makeOrder: preparing command list for order [%d]\n", drink_order_id)
-  cmdList, ret := getCommandList(drink_order_id)
-  
-  if ret != 0 {
-    fmt.Printf("makeOrder: failed to generate command list!\n")
-    details.Success = false
-    details.FailReason = "Missing ingrediant(s)"
-    t, _ := template.ParseFiles("order_make.html")
-    t.Execute(w, details)
-    return true
-  }
-  details.Success = true
-
-  // Record start time of order
-  _, err = db.Exec(
-    "update drink_order set made_start_ts = ? where id = ?",
-    int32(time.Now().Unix()),
-    drink_order_id,
-  )
+  details.Position, err = queueOrder(db, drink_order_id)
   if err != nil {
-    panic(fmt.Sprintf("completeOrder: Failed to update db: %v", err))
+    details.Success = false
+    details.FailReason = err.Error()
+  } else {
+    details.Success = true
   }
   
-  BarbotSerialChan <- cmdList
-  
   t, _ := template.ParseFiles("order_make.html")
   t.Execute(w, details)
     
   return true
 }
 
+// queueOrder passes an order to the dispatcher to be made, and returns its position in the queue
+func queueOrder(db *sql.DB, drink_order_id int) (int, error) {
+  var status string
+  row := db.QueryRow("select status from drink_order where id = ?", drink_order_id)
+  if err := row.Scan(&status); err == sql.ErrNoRows {
+    return 0, ErrOrderNotFound
+  } else if err != nil {
+    return 0, err
+  }
+
+  // Check a command list can be generated. This will fail if not all the ingrediants are present.
+  // The dispatcher generates it again when the order is sent, in case the dispensers have changed.
+  fmt.Printf("queueOrder: preparing command list for order [%d]\n", drink_order_id)
+  _, _, err := getCommandListAndUsage(drink_order_id)
+  
+  if err != nil {
+    fmt.Printf("queueOrder: failed to generate command list: %v\n", err)
+    return 0, err
+  }
+  
+  // An order that's already READY (e.g. "Make" clicked twice, or left over from a restart) just needs to
+  // be in the queue
+
+  if status != ORDER_READY {
+    err = setOrderStatus(db, drink_order_id, ORDER_READY, "")
+    if err != nil {
+      return 0, err
+    }
+  }
+  
+  return BarbotDispatcher.Enqueue(drink_order_id), nil
+}
+
 // completeOrder marks the drink as made in the database, then redirects to the order list
 func completeOrder(db *sql.DB, w http.ResponseWriter, r *http.Request, p string) bool {
 
@@ -707,13 +1458,9 @@ func completeOrder(db *sql.DB, w http.ResponseWriter, r *http.Request, p string)
     return false 
   } 
   
-  _, err = db.Exec(
-    "update drink_order set made_end_ts = ? where id = ?",
-    int32(time.Now().Unix()),
-    drink_order_id,
-  )
+  err = setOrderStatus(db, drink_order_id, ORDER_DONE, "completed by bartender")
   if err != nil {
-    panic(fmt.Sprintf("completeOrder: Failed to update db: %v", err))
+    fmt.Printf("completeOrder: %v\n", err)
   }
   
   http.Redirect(w, r, "/orderlist/", http.StatusSeeOther)
@@ -738,7 +1485,6 @@ func recipeContainsAlcohol(tx *sql.Tx, recipe_id string) bool {
   err := row.Scan(&alcoholic)
   if err != nil {
     panic(fmt.Sprintf("recipeContainsAlcohol failed: %v", err))
-    return true
   }
   
   if alcoholic > 0 {
@@ -751,62 +1497,164 @@ func recipeContainsAlcohol(tx *sql.Tx, recipe_id string) bool {
 
 func orderDrinkHandler(w http.ResponseWriter, r *http.Request) {
   
-    var err error
-    var db *sql.DB
-    
     if len(r.URL.Path) <= len("/order/") {
       http.NotFound(w, r)
       return
-    } else {
-       // Open database
-      db = getDBConnection()
+    }
+
+    // Open database
+    db := getDBConnection()
+    defer db.Close()
+
+    size := r.FormValue("size")
+    if size == "" {
+      size = SIZE_SINGLE
+    }
+
+    order_id, err := createOrder(db, r.URL.Path[len("/order/"):], size)
+    if err == sql.ErrNoRows {
+      http.NotFound(w, r)
+      return
+    }
+    if err == ErrGlassTooSmall || err == ErrUnknownSize {
+      http.Error(w, err.Error(), http.StatusBadRequest)
+      return
+    }
+    if err != nil {
+      panic(fmt.Sprintf("Insert order failed: %v", err))
+    }
+
+    var orderLogged OrderLogged
+    orderLogged.OrderId = fmt.Sprintf(ORDER_FMT, order_id)
+    if estimate, ok := estimateOrders(db)[order_id]; ok {
+      orderLogged.Wait = formatWait(estimate.Wait)
+      orderLogged.Ahead = estimate.Ahead
+    }
+    t, _ := template.ParseFiles("order_logged.html")
+    t.Execute(w, orderLogged)
+  }
+
+// createOrder logs an order for a drink, and returns its drink_order.id. Returns sql.ErrNoRows if the drink isn't
+// known, or ErrGlassTooSmall if it can't be made in the size asked for.
+func createOrder(db *sql.DB, recipe_id string, size string) (int, error) {
+   tx, err := db.Begin()
+   if err != nil {
+     return 0, err
    }
-   defer db.Close()
-   tx, _ := db.Begin()
    defer tx.Rollback()
 
-   recipe_id := r.URL.Path[len("/order/"):]
-
    // Check drink is known
    var menuitem MenuItem
    row := tx.QueryRow("select id, name from recipe where id = ?", recipe_id)
    err = row.Scan(&menuitem.Id, &menuitem.DrinkName)
-   if err == sql.ErrNoRows {
-     http.NotFound(w, r)
-     return
+   if err != nil {
+     return 0, err
+   }
+
+   err = checkDrinkSize(db, menuitem.Id, size)
+   if err != nil {
+     return 0, err
    }
 
    alcoholic := recipeContainsAlcohol(tx, recipe_id)
 
+   // Alcoholic drinks can't be made until the bartender has checked ID
+   status := ORDER_QUEUED
+   if alcoholic {
+     status = ORDER_ID_CHECK_REQUIRED
+   }
+   now := int32(time.Now().Unix())
+
    // Generate order
-   _, insertErr := tx.Exec(
-     "insert into drink_order (create_ts, recipe_id, alcohol, id_checked, cancelled) VALUES (?, ?, ?, ?, ?)",
-     int32(time.Now().Unix()),
+   _, err = tx.Exec(
+     "insert into drink_order (create_ts, recipe_id, alcohol, id_checked, cancelled, status, status_ts, size) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+     now,
      recipe_id,
      alcoholic,
      false,
      false,
+     status,
+     now,
+     size,
    )
-   if insertErr != nil {
-     panic(fmt.Sprintf("Insert order failed: %v", insertErr))
+   if err != nil {
+     return 0, err
    }
 
-   var orderLogged OrderLogged
+   // Order reference (id)
+   row = tx.QueryRow("select max(id) from drink_order")
+   var order_id int
+   err = row.Scan(&order_id)
+   if err != nil {
+     return 0, err
+   }
 
-    // Order reference (id)
-    row = tx.QueryRow("select max(id) from drink_order")
-    var order_id int
-    err = row.Scan(&order_id)
-    orderLogged.OrderId = fmt.Sprintf(ORDER_FMT, order_id)
-    if err == sql.ErrNoRows {
-      http.NotFound(w, r)
-      return
-    }
-    tx.Commit()
-    t, _ := template.ParseFiles("order_logged.html")
-    t.Execute(w, orderLogged)
+   err = recordOrderStatus(tx, order_id, status, now, "")
+   if err != nil {
+     return 0, err
+   }
+
+   err = tx.Commit()
+   if err != nil {
+     return 0, err
+   }
+   publishOrderEvent(db, order_id, status)
+
+   // Model it now, from where the platform will be by the time it's made, rather than each time it's estimated
+   modelOrders(db)
+   return order_id, nil
+}
+
+
+// orderStatusHandler handles requests to /status/<ref>, showing a customer how their order is getting on.
+// The page keeps itself up to date using the events from /events/.
+func orderStatusHandler(w http.ResponseWriter, r *http.Request) {
+  var page OrderStatusPage
+
+  if len(r.URL.Path) <= len("/status/") {
+    http.NotFound(w, r)
+    return
+  }
+
+  drink_order_id, err := strconv.Atoi(r.URL.Path[len("/status/"):])
+  if err != nil {
+    http.NotFound(w, r)
+    return
   }
 
+  db := getDBConnection()
+  defer db.Close()
+
+  sqlstr := `
+    select r.name, do.status
+    from drink_order do
+    inner join recipe r on r.id = do.recipe_id
+    where do.id = ?`
+
+  row := db.QueryRow(sqlstr, drink_order_id)
+  err = row.Scan(&page.DrinkName, &page.Status)
+  if err == sql.ErrNoRows {
+    http.NotFound(w, r)
+    return
+  }
+  if err != nil {
+    panic(fmt.Sprintf("orderStatusHandler failed: %v", err))
+  }
+  page.OrderRef = fmt.Sprintf(ORDER_FMT, drink_order_id)
+  page.Message = customerStatusMessage(page.Status)
+
+  t, _ := template.ParseFiles("order_status.html")
+  t.Execute(w, page)
+}
+
+// orderBoardHandler handles requests to /board/, a list of all orders in progress for a big screen
+func orderBoardHandler(w http.ResponseWriter, r *http.Request) {
+  db := getDBConnection()
+  defer db.Close()
+
+  t, _ := template.ParseFiles("order_board.html")
+  t.Execute(w, getBoardOrders(db))
+}
 
 // getDBConnection opens and returns a database connection
 func getDBConnection() *sql.DB {
@@ -819,177 +1667,321 @@ func getDBConnection() *sql.DB {
   return db
 }
 
-// BBSerial goroutine manages serial communications with barbot
-func BBSerial(instructionList chan []string, serialPort string) {
-  
-  // Open serial port
-  port := &serial.Config{Name: serialPort, Baud: 115200} 
-  s, err := serial.OpenPort(port)
-  if err != nil {
-    panic(fmt.Sprintf("BBSerial failed to open serial port: %v", err))
-  }
-  
-
-  serialReadChan := make(chan string)
- 
-  // read from serial port
-  go func() {
-    reader := bufio.NewReader(s)
+var ErrMissingIngredients = errors.New("Missing ingrediant(s)")
+var ErrNothingToDispense = errors.New("Nothing for barbot to dispense (has the recipe been emptied or deleted?)")
 
-    for {
-      buf, err := reader.ReadBytes('\n')
-      if err != nil {
-        fmt.Printf("Error reading from serial port [%v]\n", err);
-        return
-      }
-      var msg string
-      msg = strings.Trim(fmt.Sprintf("%s", buf),"\n")
-      if (len(buf) > 1) {
-        serialReadChan <- msg
-      }
-    }
-  }()
+// getCommandListAndUsage takes a drink_order_id, and returns the instructions to be sent to barbot to make it,
+// how much will be used from each dispenser (dispenser_id -> amount, in the units shown to the user - e.g. ml
+// or dashes), and why the list couldn't be generated (ErrOrderNotFound, ErrMissingIngredients, ErrNothingToDispense, ErrGlassTooSmall or an
+// InstructionError) if it couldn't.
+func getCommandListAndUsage(drink_order_id int) ([]string, map[int]int, error) {
+  db := getDBConnection()
+  defer db.Close()
 
-  for {
-    select {
-      case cmdList := <-instructionList:
-        for _, cmd := range cmdList {
-          fmt.Printf("> %s\n", cmd)
-          _, err := s.Write([]byte(fmt.Sprintf("%s\n", cmd)))
-          time.Sleep(10 * time.Millisecond) // 10ms delay between each instruction; don't send commands faster than the Arduino can process them
-          if err != nil {
-            panic(fmt.Sprintf("BBSerial: failed to transmit instruction: %v", err))
-          }
-        }
+  var recipe_id int
+  var size string
+  row := db.QueryRow("select recipe_id, size from drink_order where id = ?", drink_order_id)
+  err := row.Scan(&recipe_id, &size)
+  if err == sql.ErrNoRows {
+    return nil, nil, ErrOrderNotFound
+  }
+  if err != nil {
+    return nil, nil, fmt.Errorf("getCommandListAndUsage failed: %v", err)
+  }
 
-      case recieced_msg := <-serialReadChan:
-        fmt.Printf("< %s\n", recieced_msg)
-    }
+  plan, err := getDrinkPlan(db, recipe_id, size, getParkedAt(), false)
+  if err != nil {
+    return nil, nil, err
   }
-  
+  return plan.Commands, plan.Usage, nil
+}
+
+// DrinkPlan is how barbot will make a drink
+type DrinkPlan struct {
+  Commands  []string
+  Steps     []PlanStep   // In the order they'll be dispensed
+  Park      int          // Where the platform is left afterwards
+  Usage     map[int]int  // Amount used from each dispenser
+  Volume    int          // Total volume of liquid (ml)
 }
 
-// getCommandList takes a drink_order_id, and returns a set of insturctions to be sent to barbot to make it
-func getCommandList(drink_order_id int) ([]string, int) {
+// getDrinkPlan works out the instructions to make a size of recipe_id, with the platform starting at rail
+// position start. If the instructions are generated but barbot can't carry them out, they're returned
+// along with the InstructionError (so they can be previewed). quiet stops the steps being logged, for when
+// the drink's only being planned (e.g. for a preview or estimate) rather than made.
+func getDrinkPlan(db *sql.DB, recipe_id int, size string, start int, quiet bool) (DrinkPlan, error) {
 /*
  * Instructions generated:
  *   M nnnnn               - move to rail position nnnnn
  *   D nn xxxx             - Dispense using dispenser nn, with parameter xxxx
  * 
  */
+  var plan DrinkPlan
+
+  // If the platform's position isn't known, barbot's zeroed before the drink is made
+  if start < 0 {
+    start = ZERO_POSITION
+  }
+
+  // Work out how much to scale the recipe by, for the size of drink ordered
+  volume, glass_ml := getRecipeVolume(db, recipe_id)
+  scale, err := sizeScale(size, volume, glass_ml)
+  if err != nil {
+    return plan, err
+  }
+
+  steps, usage, scaled_volume, err := getRecipeSteps(db, recipe_id, scale, start, quiet)
+  if err != nil {
+    return plan, err
+  }
+  if len(steps) == 0 {
+    return plan, ErrNothingToDispense
+  }
+
+  // A single is made as the recipe says, even if it's been set up with too big a measure for the glass
+  if size != SIZE_SINGLE && glass_ml > 0 && scaled_volume > glass_ml {
+    return plan, ErrGlassTooSmall
+  }
+
+  // Dispense in the order that means least travel, then park wherever's nearest
+  steps, park := planSteps(steps, start)
   
-   db := getDBConnection()
-   defer db.Close()
- 
+  commandList := make([]string, 0)
+  
+  // Clear any previous instructions
+  commandList = append(commandList, fmt.Sprintf("C"))
+  
+  // Each dispenser has to be the type the database says it is on barbot as well, or "D" would run something else
+  var type_err error
+  for _, step := range steps {
+    cmds := dispenseCommands(step.RailPosition, step.DispenserId, step.DispenserType, step.Qty, step.Param)
+    if err := BarbotProfile.CheckDispenser(step.DispenserId, step.DispenserType); err != nil && type_err == nil {
+      type_err = &InstructionError{Cmd: cmds[len(cmds)-1], Reason: err.Error()}
+    }
+    commandList = append(commandList, cmds...)
+  }
+
+  // move to parking position when done
+  commandList = append(commandList, fmt.Sprintf("M %d", park))
+  
+  // Go!
+  commandList = append(commandList, fmt.Sprintf("G"))
+
+  plan = DrinkPlan{Commands: commandList, Steps: steps, Park: park, Usage: usage, Volume: scaled_volume}
+
+  // Refuse anything barbot can't do (e.g. a dispenser set up at an id that has nothing attached), rather
+  // than sending it and getting the wrong drink
+  if type_err != nil {
+    return plan, type_err
+  }
+  if err = BarbotProfile.CheckInstructions(commandList); err != nil {
+    return plan, err
+  }
+
+  return plan, nil
+}
+
+// getRecipeSteps returns the (non-manual) ingredients of a recipe, in recipe order, with liquids scaled by
+// scale and the dispenser each will come from (the nearest to the one before, starting from start). Also
+// returns how much will be used from each dispenser, and the total volume of liquid. Each step is logged unless
+// quiet is set.
+func getRecipeSteps(db *sql.DB, recipe_id int, scale float64, start int, quiet bool) ([]PlanStep, map[int]int, int, error) {
    // Get a list of ingrediants required
    sqlstr := `select 
                 i.id,
                 ri.qty,
-                i.dispenser_param,
+                ifnull(ri.dispenser_param, i.dispenser_param),
                 dt.id,
-                dt.unit_size
-              from drink_order do
-              inner join recipe r on r.id = do.recipe_id
-              inner join recipe_ingredient ri on ri.recipe_id = r.id
+                dt.unit_size,
+                dt.unit_name = 'ml',
+                ifnull(ri.step_group, 0)
+              from recipe_ingredient ri
               inner join ingredient i on i.id = ri.ingredient_id
               inner join dispenser_type dt on dt.id = i.dispenser_type_id
-              where do.id = ?
+              where ri.recipe_id = ?
                 and dt.manual = 0
               order by ri.seq`
 
-  rows, err := db.Query(sqlstr, drink_order_id)
+  rows, err := db.Query(sqlstr, recipe_id)
   if err != nil {
     panic(fmt.Sprintf("%v", err))
   }
   defer rows.Close()
 
-  
-  commandList := make([]string, 1)
-  
-  // Clear any previous instructions
-  commandList = append(commandList, fmt.Sprintf("C"))
-  
+  type recipeIngredient struct {
+    step       PlanStep
+    unit_size  int
+    liquid     bool
+  }
+  var ingredients []recipeIngredient
   for rows.Next() {
-    var ingredient_id int
-    var qty int
-    var dispenser_param int
-    var dispenser_type int
-    var unit_size int
-      
-    rows.Scan(&ingredient_id, &qty, &dispenser_param, &dispenser_type, &unit_size)
+    var ingr recipeIngredient
+    rows.Scan(&ingr.step.IngredientId, &ingr.step.Qty, &ingr.step.Param, &ingr.step.DispenserType, &ingr.unit_size, &ingr.liquid, &ingr.step.Group)
+    ingredients = append(ingredients, ingr)
+  }
+  rows.Close()
+
+  var steps []PlanStep
+  usage := make(map[int]int)
+  used := make(map[int]int)  // measures taken from each dispenser so far
+  scaled_volume := 0
+  position := start
+  
+  for _, ingr := range ingredients {
+    step := ingr.step
+    if ingr.liquid {
+      step.Qty = scaleQty(step.Qty, scale)
+      scaled_volume += step.Qty * ingr.unit_size
+    }
     
-    rail_position, dispenser_id := getIngredientPosition(ingredient_id)
-    if dispenser_id == -1 {
-      return nil, -1
+    // Take it from the nearest dispenser with enough left, or split it between several if need be
+    dispensers := getIngredientDispensers(db, step.IngredientId, ingr.unit_size)
+    shares := allocateIngredient(dispensers, step.Qty, position, used)
+    if shares == nil {
+      if !quiet {
+        fmt.Printf("getRecipeSteps: ingredient_id = %d not found (or not enough left)!\n", step.IngredientId)
+      }
+      return nil, nil, 0, ErrMissingIngredients
     }
 
-    // move to the correct position
-    commandList = append(commandList, fmt.Sprintf("M %d", rail_position))
-
-    // Dispense
-    if dispenser_type == DISPENSER_MIXER || dispenser_type == DISPENSER_SYRINGE {
-      // For the mixer and syringe, send qty as the number of milliseconds to dispense for
-      commandList = append(commandList, fmt.Sprintf("D% d %d", dispenser_id, qty * dispenser_param))
-    } else {
-      for qty > 0 {
-        qty--
-        commandList = append(commandList, fmt.Sprintf("D% d %d", dispenser_id, dispenser_param))
+    for _, share := range shares {
+      split := step
+      split.DispenserId = share.Dispenser.Id
+      split.RailPosition = share.Dispenser.RailPosition
+      split.Qty = share.Qty
+      if len(shares) > 1 && split.Group == 0 {
+        // The parts can go in any order, as long as they're together
+        split.Group = -step.IngredientId
+      }
+      if !quiet {
+        fmt.Printf("getRecipeSteps: ingredient_id=[%d] x %d from dispenser_id=[%d], position=[%d]\n", split.IngredientId, split.Qty, split.DispenserId, split.RailPosition)
       }
+
+      usage[split.DispenserId] += split.Qty * ingr.unit_size
+      steps = append(steps, split)
+      position = split.RailPosition
     }
   }
-  
-  // move to home position when done
-  commandList = append(commandList, fmt.Sprintf("M 0"))
-  
-  // Go!
-  commandList = append(commandList, fmt.Sprintf("G"))
 
-  return commandList, 0
+  return steps, usage, scaled_volume, nil
 }
 
-// getIngredientPosition returns a suitable rail_position and dispenser_id for the requested ingrediant
-func getIngredientPosition(ingredient_id int) (int, int) {
-  
-   db := getDBConnection()
-   defer db.Close()
-  
-  sqlstr := `select d.id, d.rail_position
-             from dispenser d
-             inner join ingredient i on i.id = d.ingredient_id
-             where i.id = ?
-             `
-  row := db.QueryRow(sqlstr, ingredient_id)
+// dispenseCommands returns the instructions to move to a dispenser and dispense qty from it
+func dispenseCommands(rail_position int, dispenser_id int, dispenser_type int, qty int, dispenser_param int) []string {
+  var commandList []string
 
-  var dispenser_id int
-  var rail_position int
+  // move to the correct position
+  commandList = append(commandList, fmt.Sprintf("M %d", rail_position))
 
-  err := row.Scan(&dispenser_id, &rail_position)
-  if err == sql.ErrNoRows {
-    fmt.Printf("getIngredientPosition: ingredient_id = %d not found!\n", ingredient_id)
-    return -1, -1
-  }
-  if err != nil {
-    panic(fmt.Sprintf("getIngredientPosition failed: %v", err))
+  // Dispense
+  if dispenser_type == DISPENSER_MIXER || dispenser_type == DISPENSER_SYRINGE {
+    // For the mixer and syringe, send qty as the number of milliseconds to dispense for
+    commandList = append(commandList, fmt.Sprintf("D% d %d", dispenser_id, qty * dispenser_param))
+  } else {
+    for qty > 0 {
+      qty--
+      commandList = append(commandList, fmt.Sprintf("D% d %d", dispenser_id, dispenser_param))
+    }
   }
-  fmt.Printf("getIngredientPosition: ingredient_id=[%d] is on dispenser_id=[%d], position=[%d]\n", ingredient_id, dispenser_id, rail_position)
 
-  return rail_position,dispenser_id
+  return commandList
 }
 
 func main() {
   
+  var transportKind = flag.String("transport", "serial", "How to connect to barbot: serial, tcp or sim (simulated barbot)")
+  var simulate = flag.Bool("simulate", false, "Same as -transport sim")
   var serialPort = flag.String("serial", "/dev/ttyS0", "Serial port to use")
+  var address = flag.String("addr", "raspberrypi:2000", "host:port to connect to for -transport tcp (e.g. ser2net)")
+  var autoAdvance = flag.Bool("auto", false, "Automatically make pending orders, oldest first, whenever barbot is idle")
+  var addUser = flag.String("adduser", "", "Add a user (or change their password/role), then exit. The password is read from stdin.")
+  var role = flag.String("role", ROLE_BARTENDER, "Role for -adduser: customer, bartender or admin")
+  var exportFile = flag.String("export-recipes", "", "Write all recipes to a .json or .yaml file, then exit")
+  var importFile = flag.String("import-recipes", "", "Add/update recipes from a .json or .yaml file, then exit")
+  var importDryRun = flag.Bool("import-dry-run", false, "With -import-recipes, report what would change without changing anything")
+  flag.BoolVar(&CustomerLoginRequired, "customer-login", false, "Require customers to log in before ordering")
+  flag.IntVar(&LowStockPercent, "low-stock", LowStockPercent, "Default low stock alert level, as a percentage of each dispenser's capacity")
+  flag.StringVar(&AlertWebhook, "alert-webhook", "", "URL to POST low stock alerts to (JSON), e.g. http://localhost:9000/barbot")
+  var dryRun = flag.Bool("dry-run", false, "Log instructions instead of sending them to barbot (a simulated barbot carries them out)")
+  var parking = flag.String("parking", "0", "Rail positions the platform can be left at after a drink (comma separated); the nearest is used")
   flag.Parse()
+
+  var perr error
+  ParkingPositions, perr = parseParkingPositions(*parking)
+  if perr != nil {
+    fmt.Printf("-parking: %v\n", perr)
+    os.Exit(1)
+  }
+
+  if *addUser != "" {
+    err := addUserFromCommandLine(*addUser, *role)
+    if err != nil {
+      fmt.Printf("Failed to add user: %v\n", err)
+      os.Exit(1)
+    }
+    return
+  }
+
+  if *exportFile != "" {
+    err := exportRecipesToFile(*exportFile)
+    if err != nil {
+      fmt.Printf("Failed to export recipes: %v\n", err)
+      os.Exit(1)
+    }
+    return
+  }
+
+  if *importFile != "" {
+    err := importRecipesFromFile(*importFile, *importDryRun)
+    if err != nil {
+      fmt.Printf("Failed to import recipes: %v\n", err)
+      os.Exit(1)
+    }
+    return
+  }
+
+  checkUsersExist()
+
+  // The simulator is created here, before anything else can look at BarbotSim, and lasts as long as the server
+  if *simulate {
+    *transportKind = "sim"
+  }
+  if *transportKind == "sim" || *dryRun {
+    BarbotSim = NewBarbotSimulator()
+  }
+  transport, err := newTransport(*transportKind, *serialPort, *address, BarbotSim)
+  if err != nil {
+    panic(fmt.Sprintf("%v", err))
+  }
+  if *dryRun {
+    transport = &DryRunTransport{Instead: transport, Sim: BarbotSim}
+  }
   
-  http.HandleFunc("/menu/", drinksMenuHandler)
-  http.HandleFunc("/order/", orderDrinkHandler)
-  http.HandleFunc("/orderlist/", orderListHandler) // TODO: password protect (e.g. using go-http-auth)
-  http.HandleFunc("/admin/", adminHandler)
+  http.HandleFunc("/menu/", withSession(ROLE_CUSTOMER, drinksMenuHandler))
+  http.HandleFunc("/order/", withSession(ROLE_CUSTOMER, orderDrinkHandler))
+  http.HandleFunc("/orderlist/", withSession(ROLE_BARTENDER, orderListHandler))
+  http.HandleFunc("/admin/", withSession(ROLE_ADMIN, adminHandler))
+  http.HandleFunc("/status/", orderStatusHandler)
+  http.HandleFunc("/board/", orderBoardHandler)
+  http.HandleFunc("/events/", orderEventsHandler)
+  http.HandleFunc("/api/v1/", withSession("", apiHandler))
+  http.HandleFunc("/login/", loginHandler)
+  http.HandleFunc("/logout/", withSession("", logoutHandler))
   http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
   http.Handle("/", http.FileServer(http.Dir("static")))
   
-  BarbotSerialChan = make(chan []string);
-  go BBSerial(BarbotSerialChan, *serialPort)
+  BarbotSerialChan = make(chan BarbotRequest);
+  fmt.Printf("Connecting to barbot using %s\n", transport)
+  go BBSerial(BarbotSerialChan, transport)
+
+  db := getDBConnection()
+  err = BarbotDispatcher.Reload(db)
+  db.Close()
+  if err != nil {
+    panic(fmt.Sprintf("Failed to reload queue: %v", err))
+  }
+  BarbotDispatcher.SetAutoAdvance(*autoAdvance)
+  go BarbotDispatcher.Run()
 
   fmt.Printf("Started...\n")
   http.ListenAndServe(":8080", nil)
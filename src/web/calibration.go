@@ -0,0 +1,324 @@
+package main
+
+import (
+  "database/sql"
+  "fmt"
+  "sync"
+  "time"
+)
+
+/*
+ * Rail position calibration. From the calibrate admin page the operator jogs the platform along the rail
+ * (with "M" instructions, in steps of their choosing) until the glass is under a dispenser, then saves
+ * the platform's position as that dispenser's rail_position.
+ *
+ * "Verify all" re-zeroes the platform, then moves it to each dispenser's saved position in turn (in rail
+ * order), so each can be checked, and adjusted if need be, before moving on to the next.
+ *
+ * The dispatcher doesn't send any drinks while calibration is in progress.
+ */
+
+const CALIBRATION_DEFAULT_STEP = 10
+const CALIBRATION_WAIT_EXTRA = 2 * time.Second  // Allowed on top of MAX_MOVE_TIME for a zero to finish
+
+var CALIBRATION_STEPS = []int{1, 10, 50, 100, 500}
+
+type CalibrationStatus struct {
+  Active     bool
+  Position   int    // Where the platform was last sent, or -1 if not known (not zeroed yet). Zeroing
+                    // leaves it at ZERO_POSITION, the far end of the rail.
+  Step       int    // Steps to move each time a jog button is clicked
+  Dispenser  int    // Dispenser being calibrated, or -1
+  Verifying  bool
+  VerifyLeft int    // Number of dispensers still to verify after this one
+  Zeroing    bool   // Waiting for a zero to finish before moving on (see zeroAndMoveTo)
+}
+
+type Calibration struct {
+  mu      sync.Mutex
+  status  CalibrationStatus
+  verify  []int  // Dispensers still to verify
+}
+
+var BarbotCalibration = &Calibration{status: CalibrationStatus{Position: -1, Step: CALIBRATION_DEFAULT_STEP, Dispenser: -1}}
+
+func (c *Calibration) Snapshot() CalibrationStatus {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.status
+}
+
+// Active returns true if calibration is in progress (so drinks shouldn't be made)
+func (c *Calibration) Active() bool {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.status.Active
+}
+
+// Start begins calibration, and zeroes the platform so its position is known
+func (c *Calibration) Start() error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  if machine := BarbotMachine.Snapshot(); machine.OrderId != 0 {
+    return fmt.Errorf("Can't calibrate whilst a drink is being made")
+  }
+  // Active is set whilst zeroing so the dispatcher keeps out of the way, but only left set if it worked
+  c.status.Active = true
+  if err := c.zero(); err != nil {
+    c.status.Active = false
+    return err
+  }
+  return nil
+}
+
+// Finish ends calibration, so the dispatcher can start making drinks again
+func (c *Calibration) Finish() {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  c.status.Active = false
+  c.status.Verifying = false
+  c.status.Zeroing = false
+  c.verify = nil
+}
+
+func (c *Calibration) SetStep(step int) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  if step > 0 && step <= MAX_RAIL_POSITION {
+    c.status.Step = step
+  }
+}
+
+func (c *Calibration) SetDispenser(dispenser_id int) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.status.Dispenser = dispenser_id
+}
+
+// Zero sends the platform back to the zero end of the rail, to reset its position
+func (c *Calibration) Zero() error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.zero()
+}
+
+// Jog moves the platform by a number of steps (e.g. -1 for one step back)
+func (c *Calibration) Jog(steps int) error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  if c.status.Position < 0 {
+    return fmt.Errorf("Zero the platform first")
+  }
+
+  position := c.status.Position + steps * c.status.Step
+  if position < 0 {
+    position = 0
+  }
+  if position > MAX_RAIL_POSITION {
+    position = MAX_RAIL_POSITION
+  }
+  return c.moveTo(position)
+}
+
+// GotoDispenser moves the platform to a dispenser's saved position
+func (c *Calibration) GotoDispenser(db *sql.DB, dispenser_id int) error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  position, err := getDispenserRailPosition(db, dispenser_id)
+  if err != nil {
+    return err
+  }
+  c.status.Dispenser = dispenser_id
+  return c.moveTo(position)
+}
+
+// Save stores the platform's current position as the rail_position of the dispenser being calibrated
+func (c *Calibration) Save(db *sql.DB) error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  if c.status.Position < 0 {
+    return fmt.Errorf("Platform position isn't known - zero it first")
+  }
+  if c.status.Dispenser < 0 {
+    return fmt.Errorf("Choose a dispenser first")
+  }
+
+  _, err := db.Exec("update dispenser set rail_position = ? where id = ?", c.status.Position, c.status.Dispenser)
+  return err
+}
+
+// StartVerify re-zeroes the platform, then moves it to the first dispenser
+func (c *Calibration) StartVerify(db *sql.DB) error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  if c.status.Zeroing {
+    return fmt.Errorf("Wait for the platform to finish zeroing")
+  }
+  rows, err := db.Query(`
+    select d.id
+    from dispenser d
+    inner join dispenser_type dt on dt.id = d.dispenser_type_id
+    where dt.manual = 0
+    order by d.rail_position, d.id`)
+  if err != nil {
+    return err
+  }
+  defer rows.Close()
+
+  c.verify = nil
+  for rows.Next() {
+    var dispenser_id int
+    rows.Scan(&dispenser_id)
+    c.verify = append(c.verify, dispenser_id)
+  }
+  rows.Close()
+
+  if len(c.verify) == 0 {
+    return fmt.Errorf("No dispensers to verify")
+  }
+
+  c.status.Verifying = true
+  return c.verifyNext(db, true)
+}
+
+// NextVerify moves on to the next dispenser to verify
+func (c *Calibration) NextVerify(db *sql.DB) error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  if !c.status.Verifying {
+    return fmt.Errorf("Not verifying")
+  }
+  if c.status.Zeroing {
+    return fmt.Errorf("Wait for the platform to finish zeroing")
+  }
+  return c.verifyNext(db, false)
+}
+
+// verifyNext moves to the next dispenser in c.verify, re-zeroing on the way if zero_first is set.
+// Must be called with c.mu held (which is released whilst zeroing).
+func (c *Calibration) verifyNext(db *sql.DB, zero_first bool) error {
+  if len(c.verify) == 0 {
+    c.status.Verifying = false
+    c.status.VerifyLeft = 0
+    return nil
+  }
+
+  dispenser_id := c.verify[0]
+  c.verify = c.verify[1:]
+  c.status.Dispenser = dispenser_id
+  c.status.VerifyLeft = len(c.verify)
+
+  position, err := getDispenserRailPosition(db, dispenser_id)
+  if err != nil {
+    return err
+  }
+  if zero_first {
+    return c.zeroAndMoveTo(position)
+  }
+  return c.moveTo(position)
+}
+
+// zero sends a "Z" instruction, which leaves the platform at ZERO_POSITION (the far end of the rail). Must be
+// called with c.mu held.
+func (c *Calibration) zero() error {
+  c.status.Position = -1
+  // Z is carried out straight away, rather than stored to run on "G"
+  return c.run([]string{"Z"})
+}
+
+// moveTo sends an "M" instruction. Must be called with c.mu held.
+func (c *Calibration) moveTo(position int) error {
+  if position < 0 || position > MAX_RAIL_POSITION {
+    return fmt.Errorf("Rail position must be from 0 to %d", MAX_RAIL_POSITION)
+  }
+  return c.run([]string{"C", fmt.Sprintf("M %d", position), "G"})
+}
+
+// zeroAndMoveTo re-zeroes the platform, waits for it to get there, then moves it to position. Must be
+// called with c.mu held, which is released whilst waiting so the calibrate page can still show what's
+// going on; nothing else is sent meanwhile, as status.Zeroing is set.
+func (c *Calibration) zeroAndMoveTo(position int) error {
+  if position < 0 || position > MAX_RAIL_POSITION {
+    return fmt.Errorf("Rail position must be from 0 to %d", MAX_RAIL_POSITION)
+  }
+  if err := c.zero(); err != nil {
+    return err
+  }
+
+  c.status.Zeroing = true
+  c.mu.Unlock()
+  err := waitForIdle(MAX_MOVE_TIME * time.Millisecond + CALIBRATION_WAIT_EXTRA)
+  c.mu.Lock()
+  if !c.status.Zeroing {
+    // Calibration was finished whilst waiting
+    return fmt.Errorf("Start calibrating first")
+  }
+  c.status.Zeroing = false
+  if err != nil {
+    return err
+  }
+  return c.moveTo(position)
+}
+
+// run sends instructions, and keeps track of where they leave the platform. Must be called with c.mu held.
+func (c *Calibration) run(cmdList []string) error {
+  err := c.send(cmdList)
+  if err != nil {
+    return err
+  }
+  for _, cmd := range cmdList {
+    c.status.Position = positionAfter(c.status.Position, cmd)
+  }
+  return nil
+}
+
+// waitForIdle waits for barbot to finish what it's doing
+func waitForIdle(timeout time.Duration) error {
+  deadline := time.Now().Add(timeout)
+  for time.Now().Before(deadline) {
+    machine := BarbotMachine.Snapshot()
+    if machine.State == STATE_IDLE {
+      return nil
+    }
+    if machine.State == STATE_FAULT || machine.State == STATE_UNKNOWN {
+      return fmt.Errorf("BarBot is %s %s", machine.State, machine.FaultReason)
+    }
+    time.Sleep(DISPATCH_POLL)
+  }
+  return fmt.Errorf("BarBot didn't finish zeroing in time")
+}
+
+// send passes instructions to barbot, as long as calibration is in progress and barbot isn't busy
+func (c *Calibration) send(cmdList []string) error {
+  if !c.status.Active {
+    return fmt.Errorf("Start calibrating first")
+  }
+  if c.status.Zeroing {
+    return fmt.Errorf("Wait for the platform to finish zeroing")
+  }
+
+  machine := BarbotMachine.Snapshot()
+  if machine.State != STATE_IDLE {
+    return fmt.Errorf("BarBot is %s - wait for it to be IDLE (or reset it)", machine.State)
+  }
+  return sendCommands(cmdList)
+}
+
+// getDispenserRailPosition returns the saved rail_position of a dispenser
+func getDispenserRailPosition(db *sql.DB, dispenser_id int) (int, error) {
+  var position int
+  row := db.QueryRow("select rail_position from dispenser where id = ?", dispenser_id)
+  err := row.Scan(&position)
+  if err == sql.ErrNoRows {
+    return -1, fmt.Errorf("Unknown dispenser %d", dispenser_id)
+  }
+  return position, err
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+  "database/sql"
+  "fmt"
+  "sync"
+  "time"
+)
+
+const DISPATCH_POLL = 500 * time.Millisecond // How often the dispatcher checks if barbot is ready for the next drink
+
+// Dispatcher owns the queue of orders waiting to be made, and sends them to barbot one at a
+// time: the next order is only sent once barbot has finished the last one and is IDLE again.
+// Orders with more instructions than barbot can hold are sent in batches the same way, each
+// once the one before has finished.
+// With auto advance on, it also takes the oldest pending order from drink_order whenever the
+// queue is empty, so the bar can run without anyone pressing "Make".
+type Dispatcher struct {
+  mu           sync.Mutex
+  queue        []int  // drink_order.ids, in the order they'll be made
+  current      int    // drink_order.id currently being made, 0 if none
+  batches      [][]string  // Batches of instructions for the current order still to be sent...
+  usages       []map[int]int  // ...and the stock each will use
+  batch        int         // Number of the last batch sent...
+  batchCount   int         // ...out of how many
+  autoAdvance  bool
+  sending      bool        // Instructions that aren't part of an order are being sent (see sendReserved)
+  wake         chan bool
+}
+
+type DispatcherStatus struct {
+  Queue        []string  `json:"queue"`
+  Current      string    `json:"current,omitempty"`
+  AutoAdvance  bool      `json:"auto_advance"`
+}
+
+var BarbotDispatcher = NewDispatcher()
+
+func NewDispatcher() *Dispatcher {
+  return &Dispatcher{wake: make(chan bool, 1)}
+}
+
+// Enqueue adds an order to the end of the queue, and returns its position (1 = next)
+func (d *Dispatcher) Enqueue(drink_order_id int) int {
+  d.mu.Lock()
+  defer d.mu.Unlock()
+
+  for ix, id := range d.queue {
+    if id == drink_order_id {
+      return ix + 1
+    }
+  }
+  d.queue = append(d.queue, drink_order_id)
+  d.poke()
+  return len(d.queue)
+}
+
+// Reload puts orders left READY (e.g. by a restart) back in the queue, oldest first, as the queue itself
+// isn't saved anywhere
+func (d *Dispatcher) Reload(db *sql.DB) error {
+  rows, err := db.Query("select id from drink_order where status = ? order by id", ORDER_READY)
+  if err != nil {
+    return err
+  }
+  defer rows.Close()
+
+  var ids []int
+  for rows.Next() {
+    var id int
+    rows.Scan(&id)
+    ids = append(ids, id)
+  }
+  rows.Close()
+
+  for _, id := range ids {
+    fmt.Printf("Dispatcher: re-queueing order [%d]\n", id)
+    d.Enqueue(id)
+  }
+  return nil
+}
+
+// Remove takes an order out of the queue (e.g. if it's been cancelled)
+func (d *Dispatcher) Remove(drink_order_id int) {
+  d.mu.Lock()
+  defer d.mu.Unlock()
+
+  for ix, id := range d.queue {
+    if id == drink_order_id {
+      d.queue = append(d.queue[:ix], d.queue[ix+1:]...)
+      return
+    }
+  }
+}
+
+func (d *Dispatcher) SetAutoAdvance(on bool) {
+  d.mu.Lock()
+  defer d.mu.Unlock()
+  d.autoAdvance = on
+  d.poke()
+}
+
+func (d *Dispatcher) Status() DispatcherStatus {
+  d.mu.Lock()
+  defer d.mu.Unlock()
+
+  var status DispatcherStatus
+  for _, id := range d.queue {
+    status.Queue = append(status.Queue, fmt.Sprintf(ORDER_FMT, id))
+  }
+  if d.current > 0 {
+    status.Current = fmt.Sprintf(ORDER_FMT, d.current)
+  }
+  status.AutoAdvance = d.autoAdvance
+  return status
+}
+
+// Orders returns the drink_order.id being made (0 if none), and those queued after it
+func (d *Dispatcher) Orders() (int, []int) {
+  d.mu.Lock()
+  defer d.mu.Unlock()
+  return d.current, append([]int(nil), d.queue...)
+}
+
+// SendWhenIdle sends instructions that aren't part of an order (e.g. maintenance), as long as barbot is IDLE
+// and nothing else is being sent. The dispatcher can't start an order until they've been sent, by which time
+// barbot has reported it's busy with them.
+func (d *Dispatcher) SendWhenIdle(cmdList []string) error {
+  d.mu.Lock()
+  machine := BarbotMachine.Snapshot()
+  if machine.State != STATE_IDLE || machine.OrderId != 0 || d.current != 0 || d.sending {
+    d.mu.Unlock()
+    return fmt.Errorf("BarBot is busy (%s) - try again when it's IDLE", machine.State)
+  }
+  return d.sendReserved(cmdList)
+}
+
+// sendReserved sends instructions that aren't part of an order, with nothing else allowed to send until
+// they've gone. Must be called with d.mu held, which it releases whilst sending, so the queue can still be
+// looked at and added to.
+func (d *Dispatcher) sendReserved(cmdList []string) error {
+  d.sending = true
+  d.mu.Unlock()
+
+  err := sendCommands(cmdList)
+
+  d.mu.Lock()
+  d.sending = false
+  d.poke()
+  d.mu.Unlock()
+  return err
+}
+
+// poke wakes the dispatcher up. Must be called with d.mu held.
+func (d *Dispatcher) poke() {
+  select {
+    case d.wake <- true:
+    default:
+  }
+}
+
+// Run is the dispatcher goroutine
+func (d *Dispatcher) Run() {
+  ticker := time.NewTicker(DISPATCH_POLL)
+  defer ticker.Stop()
+
+  for {
+    select {
+      case <-d.wake:
+      case <-ticker.C:
+    }
+    d.dispatchNext()
+  }
+}
+
+// dispatchNext sends the next order to barbot, if it's ready for one
+func (d *Dispatcher) dispatchNext() {
+  machine := BarbotMachine.Snapshot()
+
+  d.mu.Lock()
+  if d.sending {
+    // Leave it to whatever's being sent; it pokes the dispatcher when it's done
+    d.mu.Unlock()
+    return
+  }
+  if d.current > 0 {
+    if machine.OrderId == d.current {
+      // Still being made
+      d.mu.Unlock()
+      return
+    }
+
+    if len(d.batches) > 0 {
+      switch machine.State {
+        case STATE_IDLE:
+          // Finished the last batch, so send the next
+          d.sendNextBatch()
+          return
+
+        case STATE_FAULT:
+          // Order has already been failed
+          fmt.Printf("Dispatcher: order [%d] stopped after batch %d of %d\n", d.current, d.batch, d.batchCount)
+
+        case STATE_UNKNOWN:
+          drink_order_id, reason := d.current, fmt.Sprintf("lost barbot after batch %d of %d", d.batch, d.batchCount)
+          d.batches, d.usages = nil, nil
+          d.current = 0
+          d.mu.Unlock()
+          updateOrderStatus(drink_order_id, ORDER_FAILED, reason)
+          return
+
+        default:
+          d.mu.Unlock()
+          return
+      }
+      d.batches, d.usages = nil, nil
+    }
+    d.current = 0
+  }
+
+  // Barbot needs to be IDLE before sending anything; if it's faulted, wait for someone to reset it.
+  // Also leave it alone whilst it's being calibrated.
+  if machine.State != STATE_IDLE || machine.OrderId != 0 || BarbotCalibration.Active() {
+    d.mu.Unlock()
+    return
+  }
+
+  // After a fault the platform might not be where barbot thinks it is, so re-zero it before the next drink
+  if getParkedAt() < 0 && (len(d.queue) > 0 || d.autoAdvance) {
+    fmt.Printf("Dispatcher: platform position not known - zeroing before the next drink\n")
+    if err := d.sendReserved([]string{"Z"}); err != nil {
+      fmt.Printf("Dispatcher: failed to zero: %v\n", err)
+    }
+    return
+  }
+
+  drink_order_id := 0
+  auto := false
+  if len(d.queue) > 0 {
+    drink_order_id = d.queue[0]
+    d.queue = d.queue[1:]
+  } else if d.autoAdvance {
+    drink_order_id = nextPendingOrder()
+    auto = true
+  }
+  d.current = drink_order_id
+  d.mu.Unlock()
+
+  // Orders are only written to the database with d.mu released, so nothing waiting on the dispatcher (e.g. a
+  // page showing the queue) holds up the database, or the other way round
+  if drink_order_id <= 0 {
+    return
+  }
+  if auto {
+    updateOrderStatus(drink_order_id, ORDER_READY, "auto")
+  }
+
+  batches, usages, err := startOrder(drink_order_id)
+  if err != nil {
+    fmt.Printf("Dispatcher: order [%d] failed: %v\n", drink_order_id, err)
+    updateOrderStatus(drink_order_id, ORDER_FAILED, err.Error())
+  }
+
+  d.mu.Lock()
+  if err != nil {
+    d.current = 0
+  } else if len(batches) > 1 && d.current == drink_order_id {
+    d.batches = batches[1:]
+    d.usages = usages[1:]
+    d.batch = 1
+    d.batchCount = len(batches)
+  }
+  d.mu.Unlock()
+}
+
+// sendNextBatch sends the next batch of instructions for the current order. Must be called with d.mu
+// held, which it releases.
+func (d *Dispatcher) sendNextBatch() {
+  drink_order_id := d.current
+  batch, usage := d.batches[0], d.usages[0]
+  d.batches, d.usages = d.batches[1:], d.usages[1:]
+  d.batch++
+  batch_num := d.batch
+  batch_count := d.batchCount
+  d.mu.Unlock()
+
+  fmt.Printf("Dispatcher: sending batch %d of %d for order [%d]\n", batch_num, batch_count, drink_order_id)
+  err := sendOrderBatch(drink_order_id, batch_num, batch_count, batch)
+  if err != nil {
+    fmt.Printf("Dispatcher: order [%d] failed: %v\n", drink_order_id, err)
+    updateOrderStatus(drink_order_id, ORDER_FAILED, err.Error())
+    d.mu.Lock()
+    d.batches, d.usages = nil, nil
+    d.current = 0
+    d.mu.Unlock()
+    return
+  }
+
+  db := getDBConnection()
+  defer db.Close()
+  useStock(db, usage)
+}
+
+// startOrder generates the instructions for an order, and sends them to barbot - or if there are more
+// than it can hold, the first batch of them. Returns all the batches, and the stock each uses (only the
+// first batch's is taken off here; the rest are taken off as they're sent).
+func startOrder(drink_order_id int) ([][]string, []map[int]int, error) {
+  fmt.Printf("startOrder: preparing command list for order [%d]\n", drink_order_id)
+  start := getParkedAt()
+  cmdList, usage, err := getCommandListAndUsage(drink_order_id)
+  if err != nil {
+    return nil, nil, err
+  }
+
+  batches := splitCommandList(cmdList)
+  for _, batch := range batches {
+    if err = checkCommandList(batch); err != nil {
+      return nil, nil, err
+    }
+  }
+  usages := splitUsage(usage, batches)
+
+  // Mark as dispatched before sending, as barbot reports it's started making the drink before acknowledging "G"
+  db := getDBConnection()
+  err = setOrderStatus(db, drink_order_id, ORDER_DISPATCHED, "")
+  db.Close()
+  if err != nil {
+    // e.g. cancelled whilst in the queue
+    fmt.Printf("startOrder: not sending order [%d]: %v\n", drink_order_id, err)
+    return nil, nil, nil
+  }
+
+  err = sendOrderBatch(drink_order_id, 1, len(batches), batches[0])
+  if err != nil {
+    return nil, nil, err
+  }
+
+  db = getDBConnection()
+  defer db.Close()
+  useStock(db, usages[0])
+  modelOrderStart(db, drink_order_id, start)
+  return batches, usages, nil
+}
+
+// nextPendingOrder returns the oldest order that hasn't been started, or 0 if there are none
+func nextPendingOrder() int {
+  db := getDBConnection()
+  defer db.Close()
+
+  sqlstr := `
+    select min(id)
+    from drink_order
+    where status = ?`
+
+  var drink_order_id int
+  row := db.QueryRow(sqlstr, ORDER_QUEUED)
+  err := row.Scan(&drink_order_id)
+  if err != nil {
+    // min() gives null if there are no pending orders
+    return 0
+  }
+  return drink_order_id
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+  "database/sql"
+  "fmt"
+  "strings"
+)
+
+/*
+ * Adding, changing and removing dispensers from the dispenser admin page. The dispenser id is the one
+ * sent to barbot in "D" instructions, so (apart from manual dispensers, which barbot never sees) it has
+ * to be one the firmware knows about (BarbotProfile.MinDispenserId to DISPENSER_COUNT-1), and the rail
+ * position has to be within the rail (0 to MAX_RAIL_POSITION).
+ */
+
+type DispenserConfig struct {
+  Id            int
+  Name          string
+  TypeId        int
+  RailPosition  int
+  Ingredient    string
+}
+
+type DispenserType struct {
+  Id      int
+  Name    string
+  Manual  bool
+}
+
+// getDispenserConfig returns every dispenser (including manual ones), in id order
+func getDispenserConfig(db *sql.DB) []DispenserConfig {
+  var dispensers []DispenserConfig
+
+  sqlstr := `
+    select d.id, ifnull(d.name, ''), d.dispenser_type_id, d.rail_position, ifnull(i.name, '')
+    from dispenser d
+    left outer join ingredient i on i.id = d.ingredient_id
+    order by d.id`
+
+  rows, err := db.Query(sqlstr)
+  if err != nil {
+    panic(fmt.Sprintf("getDispenserConfig failed: %v", err))
+  }
+  defer rows.Close()
+
+  for rows.Next() {
+    var dispenser DispenserConfig
+    rows.Scan(&dispenser.Id, &dispenser.Name, &dispenser.TypeId, &dispenser.RailPosition, &dispenser.Ingredient)
+    dispensers = append(dispensers, dispenser)
+  }
+  return dispensers
+}
+
+// getDispenserTypes returns all the types of dispenser
+func getDispenserTypes(db *sql.DB) []DispenserType {
+  var types []DispenserType
+
+  rows, err := db.Query("select id, name, manual from dispenser_type order by id")
+  if err != nil {
+    panic(fmt.Sprintf("getDispenserTypes failed: %v", err))
+  }
+  defer rows.Close()
+
+  for rows.Next() {
+    var dispenser_type DispenserType
+    rows.Scan(&dispenser_type.Id, &dispenser_type.Name, &dispenser_type.Manual)
+    types = append(types, dispenser_type)
+  }
+  return types
+}
+
+// checkDispenser checks a dispenser's settings against what the firmware supports
+func checkDispenser(db *sql.DB, dispenser_id int, type_id int, name string, rail_position int) error {
+  var manual bool
+  row := db.QueryRow("select manual from dispenser_type where id = ?", type_id)
+  err := row.Scan(&manual)
+  if err == sql.ErrNoRows {
+    return fmt.Errorf("Unknown dispenser type %d", type_id)
+  }
+  if err != nil {
+    return err
+  }
+
+  if strings.TrimSpace(name) == "" {
+    return fmt.Errorf("Dispenser %d needs a name", dispenser_id)
+  }
+  if dispenser_id < BarbotProfile.MinDispenserId || (!manual && dispenser_id >= BarbotProfile.DispenserCount) {
+    return fmt.Errorf("Dispenser id must be from %d to %d", BarbotProfile.MinDispenserId, BarbotProfile.DispenserCount - 1)
+  }
+  if rail_position < 0 || rail_position > MAX_RAIL_POSITION {
+    return fmt.Errorf("Rail position must be from 0 to %d", MAX_RAIL_POSITION)
+  }
+  if !manual {
+    if err := BarbotProfile.CheckDispenser(dispenser_id, type_id); err != nil {
+      return fmt.Errorf("Dispenser %d can't be set up as that type: %v", dispenser_id, err)
+    }
+  }
+  return nil
+}
+
+// addDispenser adds a new (empty) dispenser
+func addDispenser(db *sql.DB, dispenser_id int, type_id int, name string, rail_position int) error {
+  if err := checkDispenser(db, dispenser_id, type_id, name, rail_position); err != nil {
+    return err
+  }
+
+  var count int
+  row := db.QueryRow("select count(*) from dispenser where id = ?", dispenser_id)
+  if err := row.Scan(&count); err != nil {
+    return err
+  }
+  if count > 0 {
+    return fmt.Errorf("There's already a dispenser %d", dispenser_id)
+  }
+
+  _, err := db.Exec(
+    "insert into dispenser (id, dispenser_type_id, name, rail_position) values (?, ?, ?, ?)",
+    dispenser_id,
+    type_id,
+    strings.TrimSpace(name),
+    rail_position,
+  )
+  return err
+}
+
+// updateDispenser changes a dispenser's type, name and rail position. Changing the type empties it, as
+// whatever was loaded won't fit the new type.
+func updateDispenser(db *sql.DB, dispenser_id int, type_id int, name string, rail_position int) error {
+  if err := checkDispenser(db, dispenser_id, type_id, name, rail_position); err != nil {
+    return err
+  }
+
+  _, err := db.Exec(
+    "update dispenser set ingredient_id = null where id = ? and dispenser_type_id != ?",
+    dispenser_id,
+    type_id,
+  )
+  if err != nil {
+    return err
+  }
+
+  _, err = db.Exec(
+    "update dispenser set dispenser_type_id = ?, name = ?, rail_position = ? where id = ?",
+    type_id,
+    strings.TrimSpace(name),
+    rail_position,
+    dispenser_id,
+  )
+  return err
+}
+
+// removeDispenser deletes a dispenser, unless it holds an ingredient that orders still to be made (or failed,
+// so might be made again) need
+func removeDispenser(db *sql.DB, dispenser_id int) error {
+  sqlstr := `
+    select count(distinct o.id), ifnull(max(i.name), '')
+    from dispenser d
+    inner join ingredient i on i.id = d.ingredient_id
+    inner join recipe_ingredient ri on ri.ingredient_id = d.ingredient_id
+    inner join drink_order o on o.recipe_id = ri.recipe_id
+    where d.id = ?
+      and o.status not in (?, ?)`
+
+  var orders int
+  var ingredient string
+  row := db.QueryRow(sqlstr, dispenser_id, ORDER_DONE, ORDER_CANCELLED)
+  if err := row.Scan(&orders, &ingredient); err != nil {
+    return err
+  }
+  if orders > 0 {
+    return fmt.Errorf("Dispenser %d has %s in it, which %d order(s) waiting to be made (or failed) need - make or cancel them first", dispenser_id, ingredient, orders)
+  }
+
+  _, err := db.Exec("delete from dispenser where id = ?", dispenser_id)
+  return err
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+  "database/sql"
+  "fmt"
+  "math"
+  "sort"
+  "sync"
+  "time"
+)
+
+/*
+ * Estimating how long drinks will take, and so how long each order has to wait.
+ *
+ * Each drink is modelled from its instructions (see commandTimer): platform moves from the rail positions,
+ * SPEED_NORMAL and MAX_ACCEL, plus each dispenser's timings. The model doesn't know about everything (e.g.
+ * waiting for a glass, or the bartender adding a garnish), so it's scaled by how long drinks have actually
+ * taken (drink_order.made_start_ts to made_end_ts) against what the model says: by the median for the
+ * same recipe and size if that's been made at least ESTIMATE_MIN_SAMPLES times recently, otherwise by the
+ * median over all recent drinks.
+ *
+ * Modelling a drink means planning it, so each order is only modelled once: when it's ordered, from where the
+ * platform should be by the time it's made, then again when it's started, from where the platform actually is.
+ */
+
+const (
+  ESTIMATE_HISTORY      = 20                // Number of recent drinks to learn from
+  ESTIMATE_MIN_SAMPLES  = 3                 // Drinks needed before their history is used
+  ESTIMATE_DEFAULT      = 60 * time.Second  // For a drink that can't be modelled (e.g. missing ingredients)
+  ESTIMATE_REFRESH      = time.Minute       // How often the history is looked at again
+)
+
+// OrderEstimate is how long an order has to wait
+type OrderEstimate struct {
+  Drink  time.Duration  // Time to make the drink itself
+  Wait   time.Duration  // Time until it's made, including the drinks ahead of it
+  Ahead  int            // Number of drinks to be made before it
+}
+
+type estimateSample struct {
+  recipe_id  int
+  size       string
+  ratio      float64  // Actual time taken / modelled time
+}
+
+var estimateHistory struct {
+  mu       sync.Mutex
+  samples  []estimateSample
+  updated  time.Time
+}
+
+// orderModel is the modelled time for an order, before scaling by how long drinks have actually taken
+type orderModel struct {
+  recipe_id  int
+  size       string
+  drink      time.Duration
+  park       int   // Where the platform's left afterwards
+  ok         bool  // false if it couldn't be modelled
+}
+
+var orderModels = struct {
+  mu      sync.Mutex
+  models  map[int]orderModel  // drink_order.id -> model
+}{models: make(map[int]orderModel)}
+
+// modelDrink returns how long the instructions to make a size of recipe_id should take, starting from rail
+// position start, and where the platform is left. Returns false if it can't be made.
+func modelDrink(db *sql.DB, recipe_id int, size string, start int) (time.Duration, int, bool) {
+  plan, err := getDrinkPlan(db, recipe_id, size, start, true)
+  if err != nil {
+    return 0, start, false
+  }
+
+  timer := newCommandTimer(start)
+  for _, cmd := range plan.Commands {
+    timer.run(cmd)
+  }
+  return timer.elapsed, plan.Park, true
+}
+
+// getEstimateSamples compares how long recent drinks took with the model
+func getEstimateSamples(db *sql.DB) ([]estimateSample, error) {
+  estimateHistory.mu.Lock()
+  defer estimateHistory.mu.Unlock()
+
+  if !estimateHistory.updated.IsZero() && time.Since(estimateHistory.updated) < ESTIMATE_REFRESH {
+    return estimateHistory.samples, nil
+  }
+
+  sqlstr := `
+    select recipe_id, size, made_end_ts - made_start_ts
+    from drink_order
+    where status = ?
+      and made_start_ts is not null
+      and made_end_ts > made_start_ts
+    order by id desc
+    limit ?`
+
+  rows, err := db.Query(sqlstr, ORDER_DONE, ESTIMATE_HISTORY)
+  if err != nil {
+    return nil, fmt.Errorf("getEstimateSamples failed: %v", err)
+  }
+  defer rows.Close()
+
+  type madeDrink struct {
+    recipe_id  int
+    size       string
+    secs       int
+  }
+  var made []madeDrink
+  for rows.Next() {
+    var drink madeDrink
+    if err = rows.Scan(&drink.recipe_id, &drink.size, &drink.secs); err != nil {
+      return nil, fmt.Errorf("getEstimateSamples failed: %v", err)
+    }
+    made = append(made, drink)
+  }
+  if err = rows.Err(); err != nil {
+    return nil, fmt.Errorf("getEstimateSamples failed: %v", err)
+  }
+  rows.Close()
+
+  var samples []estimateSample
+  for _, drink := range made {
+    modelled, _, ok := modelDrink(db, drink.recipe_id, drink.size, 0)
+    if !ok || modelled <= 0 {
+      // e.g. the recipe's changed, or an ingredient's run out since
+      continue
+    }
+    actual := time.Duration(drink.secs) * time.Second
+    samples = append(samples, estimateSample{drink.recipe_id, drink.size, float64(actual) / float64(modelled)})
+  }
+
+  estimateHistory.samples = samples
+  estimateHistory.updated = time.Now()
+  return samples, nil
+}
+
+// estimateCorrection returns how much to scale the modelled time for a size of recipe_id by, going by how
+// long drinks have actually taken
+func estimateCorrection(samples []estimateSample, recipe_id int, size string) float64 {
+  var same, all []float64
+  for _, sample := range samples {
+    if sample.recipe_id == recipe_id && sample.size == size {
+      same = append(same, sample.ratio)
+    }
+    all = append(all, sample.ratio)
+  }
+
+  switch {
+    case len(same) >= ESTIMATE_MIN_SAMPLES:
+      return median(same)
+    case len(all) >= ESTIMATE_MIN_SAMPLES:
+      return median(all)
+  }
+  return 1
+}
+
+// modelOrder models drink_order_id, starting from rail position start
+func modelOrder(db *sql.DB, drink_order_id int, start int) (orderModel, error) {
+  var model orderModel
+  row := db.QueryRow("select recipe_id, size from drink_order where id = ?", drink_order_id)
+  if err := row.Scan(&model.recipe_id, &model.size); err != nil {
+    return model, err
+  }
+
+  model.drink, model.park, model.ok = modelDrink(db, model.recipe_id, model.size, start)
+  if !model.ok {
+    model.park = start
+  }
+  return model, nil
+}
+
+// modelOrderStart models an order again now it's been started, from where the platform was when it was
+func modelOrderStart(db *sql.DB, drink_order_id int, start int) {
+  model, err := modelOrder(db, drink_order_id, start)
+  if err != nil {
+    fmt.Printf("modelOrderStart: order [%d]: %v\n", drink_order_id, err)
+    return
+  }
+
+  orderModels.mu.Lock()
+  orderModels.models[drink_order_id] = model
+  orderModels.mu.Unlock()
+}
+
+// modelOrders returns the orders still to be made, in the order they're expected to be made (the one being
+// made, then the dispatcher queue, then any others oldest first), and the model for each. Orders that haven't
+// been modelled yet are modelled from where the platform will be after the ones ahead of them; the models of
+// orders that are finished with are dropped.
+// Failed orders are left out, as they won't be made unless someone does something.
+func modelOrders(db *sql.DB) ([]int, map[int]orderModel) {
+  current, queue := BarbotDispatcher.Orders()
+
+  var order []int
+  seen := make(map[int]bool)
+  for _, id := range append(append([]int{current}, queue...), getActiveOrders(db)...) {
+    if id > 0 && !seen[id] {
+      seen[id] = true
+      order = append(order, id)
+    }
+  }
+
+  orderModels.mu.Lock()
+  defer orderModels.mu.Unlock()
+
+  var ids []int
+  models := make(map[int]orderModel)
+  position := getParkedAt()
+
+  for _, id := range order {
+    var status string
+    if err := db.QueryRow("select status from drink_order where id = ?", id).Scan(&status); err != nil {
+      continue
+    }
+    if status == ORDER_DONE || status == ORDER_FAILED || status == ORDER_CANCELLED {
+      continue
+    }
+
+    model, ok := orderModels.models[id]
+    if !ok {
+      var err error
+      model, err = modelOrder(db, id, position)
+      if err != nil {
+        continue
+      }
+    }
+
+    ids = append(ids, id)
+    models[id] = model
+    position = model.park
+  }
+
+  orderModels.models = models
+  return ids, models
+}
+
+// estimateOrders returns how long each order still to be made has to wait (drink_order.id -> estimate)
+func estimateOrders(db *sql.DB) map[int]OrderEstimate {
+  samples, err := getEstimateSamples(db)
+  if err != nil {
+    // Carry on with the model alone
+    fmt.Printf("estimateOrders: %v\n", err)
+  }
+  current, _ := BarbotDispatcher.Orders()
+  ids, models := modelOrders(db)
+
+  estimates := make(map[int]OrderEstimate)
+  var wait time.Duration
+
+  for ahead, id := range ids {
+    model := models[id]
+    drink := ESTIMATE_DEFAULT
+    if model.ok {
+      drink = time.Duration(float64(model.drink) * estimateCorrection(samples, model.recipe_id, model.size))
+    }
+
+    left := drink
+    if id == current {
+      var started sql.NullInt64
+      db.QueryRow("select made_start_ts from drink_order where id = ?", id).Scan(&started)
+      if started.Valid {
+        left -= time.Since(time.Unix(started.Int64, 0))
+        if left < 0 {
+          left = 0
+        }
+      }
+    }
+
+    wait += left
+    estimates[id] = OrderEstimate{Drink: drink, Wait: wait, Ahead: ahead}
+  }
+
+  return estimates
+}
+
+// formatWait returns a wait time the way it'd be told to a customer
+func formatWait(d time.Duration) string {
+  minutes := int(math.Ceil(d.Minutes()))
+  switch {
+    case d < 30 * time.Second:
+      return "less than a minute"
+    case minutes <= 1:
+      return "about a minute"
+  }
+  return fmt.Sprintf("about %d minutes", minutes)
+}
+
+func median(values []float64) float64 {
+  sorted := append([]float64(nil), values...)
+  sort.Float64s(sorted)
+  mid := len(sorted) / 2
+  if len(sorted) % 2 == 0 {
+    return (sorted[mid-1] + sorted[mid]) / 2
+  }
+  return sorted[mid]
+}
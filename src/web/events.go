@@ -0,0 +1,167 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "sync"
+  "time"
+)
+
+const BOARD_DONE_TIME = 10 * 60 // Seconds that finished orders stay on the board, so customers can see they're ready to collect
+
+// OrderEvent is pushed to the status pages whenever an order changes status. It includes the
+// list of orders currently in progress, so pages can work out queue positions without asking again.
+type OrderEvent struct {
+  OrderRef  string          `json:"ref"`
+  Status    string          `json:"status"`
+  Message   string          `json:"message"`
+  Orders    []BoardOrder    `json:"orders"`
+}
+
+type BoardOrder struct {
+  OrderRef  string  `json:"ref"`
+  DrinkName string  `json:"drink"`
+  Status    string  `json:"status"`
+  Message   string  `json:"message"`
+}
+
+// EventHub passes order events on to everyone listening (i.e. open status pages)
+type EventHub struct {
+  mu           sync.Mutex
+  subscribers  map[chan OrderEvent]bool
+}
+
+var OrderEventHub = &EventHub{subscribers: make(map[chan OrderEvent]bool)}
+
+func (h *EventHub) Subscribe() chan OrderEvent {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  ch := make(chan OrderEvent, 10)
+  h.subscribers[ch] = true
+  return ch
+}
+
+func (h *EventHub) Unsubscribe(ch chan OrderEvent) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  delete(h.subscribers, ch)
+}
+
+func (h *EventHub) Publish(ev OrderEvent) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  for ch := range h.subscribers {
+    select {
+      case ch <- ev:
+      default:
+        // Subscriber isn't keeping up; it'll catch up with the next event, which has the full list
+    }
+  }
+}
+
+// customerStatusMessage describes an order status in terms a customer will understand
+func customerStatusMessage(status string) string {
+  switch status {
+    case ORDER_ID_CHECK_REQUIRED:
+      return "Please show your ID to the bartender"
+    case ORDER_QUEUED, ORDER_READY:
+      return "In the queue"
+    case ORDER_DISPATCHED, ORDER_WAITING_FOR_GLASS:
+      return "Nearly there"
+    case ORDER_MAKING:
+      return "Being made"
+    case ORDER_DONE:
+      return "Ready to collect!"
+    case ORDER_FAILED:
+      return "Sorry, something went wrong - please see the bartender"
+    case ORDER_CANCELLED:
+      return "Cancelled"
+  }
+  return status
+}
+
+// getBoardOrders returns the orders in progress (and those recently finished), oldest first
+func getBoardOrders(db *sql.DB) []BoardOrder {
+  var orders []BoardOrder
+
+  sqlstr := `
+    select do.id, r.name, do.status
+    from drink_order do
+    inner join recipe r on r.id = do.recipe_id
+    where do.status not in (?, ?)
+       or (do.status = ? and do.status_ts > ?)
+    order by do.id`
+
+  rows, err := db.Query(sqlstr, ORDER_DONE, ORDER_CANCELLED, ORDER_DONE, time.Now().Unix() - BOARD_DONE_TIME)
+  if err != nil {
+    // Also called from the serial goroutine, so don't panic
+    fmt.Printf("getBoardOrders failed: %v\n", err)
+    return nil
+  }
+  defer rows.Close()
+
+  for rows.Next() {
+    var order BoardOrder
+    var id int
+    rows.Scan(&id, &order.DrinkName, &order.Status)
+    order.OrderRef = fmt.Sprintf(ORDER_FMT, id)
+    order.Message = customerStatusMessage(order.Status)
+    orders = append(orders, order)
+  }
+
+  return orders
+}
+
+// publishOrderEvent tells any open status pages that an order has changed status
+func publishOrderEvent(db *sql.DB, drink_order_id int, status string) {
+  OrderEventHub.Publish(OrderEvent{
+    OrderRef: fmt.Sprintf(ORDER_FMT, drink_order_id),
+    Status:   status,
+    Message:  customerStatusMessage(status),
+    Orders:   getBoardOrders(db),
+  })
+}
+
+// orderEventsHandler handles requests to /events/, streaming order events using Server-Sent Events
+func orderEventsHandler(w http.ResponseWriter, r *http.Request) {
+  flusher, ok := w.(http.Flusher)
+  if !ok {
+    http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+    return
+  }
+
+  ch := OrderEventHub.Subscribe()
+  defer OrderEventHub.Unsubscribe(ch)
+
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-cache")
+
+  // Start with the current list, so the page is up to date even if it was loaded a while ago
+  db := getDBConnection()
+  initial := OrderEvent{Orders: getBoardOrders(db)}
+  db.Close()
+  writeEvent(w, initial)
+  flusher.Flush()
+
+  for {
+    select {
+      case ev := <-ch:
+        writeEvent(w, ev)
+        flusher.Flush()
+
+      case <-r.Context().Done():
+        return
+    }
+  }
+}
+
+func writeEvent(w http.ResponseWriter, ev OrderEvent) {
+  data, err := json.Marshal(ev)
+  if err != nil {
+    fmt.Printf("writeEvent: %v\n", err)
+    return
+  }
+  fmt.Fprintf(w, "data: %s\n\n", data)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+  "fmt"
+  "math"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// Constants from the barbot firmware (src/arduino/lib/BarBot). Keep in step with the .h files there.
+const (
+  MAX_INSTRUCTIONS      = 100    // Maximum number of instructions barbot can store
+  MAX_MOVE_TIME         = 19000  // Maximum time (ms) a platform move may take before barbot faults
+  MAX_RAIL_POSITION     = 7080   // Maximum rail position (steps)
+  DISPENSER_COUNT       = 21     // Dispenser ids must be less than this
+  SPEED_ZERO            = 800    // Platform speed when zeroing (steps/sec)
+  SPEED_NORMAL          = 1500   // Normal platform speed (steps/sec)
+  MAX_ACCEL             = 3000   // Platform acceleration (steps/sec^2)
+  MAX_PARAM             = 65535  // Instruction parameters are uint16_t
+
+  OPTIC_DISPENSE_TIME   = 3000   // ms to hold an optic open
+  OPTIC_RECHARGE_TIME   = 2500   // minimum ms between uses of the same optic
+  DASHER_DASH_TIME      = 500    // approx ms per dash (not defined by the firmware, which counts cam pulses)
+  DASHER_TIMEOUT        = 7000
+  CONVEYOR_DISPENSE_TIME = 2000  // approx ms for a cherry/olive to reach the end sensor
+  CONVEYOR_REVERSE_TIME = 250
+  CONVEYOR_TIMEOUT      = 5000
+  SLICE_PULSE           = 50
+  SLICE_TIME            = 5000
+  STIRRER_PULSE         = 10
+  STIRRER_TIME          = 12000
+  UMBRELLA_PULSE_LEN    = 500
+  UMBRELLA_WAIT         = 1000
+)
+
+// The zero switch is at the far end of the rail: once "Z" has finished, barbot sets the platform's position
+// to MAX_RAIL_POSITION (see BarBot::loop()).
+const ZERO_POSITION = MAX_RAIL_POSITION
+
+// storedInstruction returns true for instructions barbot stores to run on "G" (M, D and Z), rather than
+// acting on straight away (C, G, R, S)
+func storedInstruction(cmd string) bool {
+  switch strings.SplitN(strings.TrimSpace(cmd), " ", 2)[0] {
+    case "M", "D", "Z":
+      return true
+  }
+  return false
+}
+
+// DeviceProfile describes the instructions a barbot will accept. Instructions are checked against it before
+// they're sent, as the firmware quietly clamps or ignores values it can't handle (e.g. a rail position past
+// the end, or a dispenser that isn't attached) rather than rejecting them.
+type DeviceProfile struct {
+  MaxInstructions  int
+  MaxRailPosition  int
+  MinDispenserId   int                          // Dispenser ids start from this...
+  DispenserCount   int                          // ...and must be less than this
+  MaxParam         int
+  DispenserType    func(dispenser_id int) int   // Type of dispenser attached as dispenser_id, or -1 if none
+}
+
+var BarbotProfile = DeviceProfile{
+  MaxInstructions: MAX_INSTRUCTIONS,
+  MaxRailPosition: MAX_RAIL_POSITION,
+  MinDispenserId:  1,
+  DispenserCount:  DISPENSER_COUNT,
+  MaxParam:        MAX_PARAM,
+  DispenserType:   firmwareDispenserType,
+}
+
+// InstructionError is returned for an instruction barbot can't carry out
+type InstructionError struct {
+  Cmd     string
+  Reason  string
+}
+
+func (e *InstructionError) Error() string {
+  return fmt.Sprintf("BarBot can't carry out instruction \"%s\": %s", e.Cmd, e.Reason)
+}
+
+// CheckInstruction checks a single instruction is one barbot understands, with parameters it can handle
+func (p DeviceProfile) CheckInstruction(cmd string) error {
+  invalid := func(format string, a ...interface{}) error {
+    return &InstructionError{Cmd: cmd, Reason: fmt.Sprintf(format, a...)}
+  }
+
+  fields := strings.Fields(cmd)
+  if len(fields) == 0 {
+    return invalid("blank instruction")
+  }
+
+  var params []int
+  for _, field := range fields[1:] {
+    param, err := strconv.Atoi(field)
+    if err != nil {
+      return invalid("parameter %q isn't a number", field)
+    }
+    params = append(params, param)
+  }
+
+  switch fields[0] {
+    case "C", "G", "R", "S", "Z":
+      if len(params) != 0 {
+        return invalid("%s doesn't take any parameters", fields[0])
+      }
+
+    case "M":
+      if len(params) != 1 {
+        return invalid("M takes one parameter (the rail position)")
+      }
+      if params[0] < 0 || params[0] > p.MaxRailPosition {
+        return invalid("rail position %d is off the end of the rail (must be from 0 to %d)", params[0], p.MaxRailPosition)
+      }
+
+    case "D":
+      if len(params) != 2 {
+        return invalid("D takes two parameters (the dispenser and its parameter)")
+      }
+      dispenser_id, param := params[0], params[1]
+      if dispenser_id < p.MinDispenserId || dispenser_id >= p.DispenserCount {
+        return invalid("there's no dispenser %d (must be from %d to %d)", dispenser_id, p.MinDispenserId, p.DispenserCount - 1)
+      }
+      dispenser_type := p.DispenserType(dispenser_id)
+      if dispenser_type < 0 {
+        return invalid("barbot has nothing attached as dispenser %d", dispenser_id)
+      }
+      if param < 0 || param > p.MaxParam {
+        if dispenser_type == DISPENSER_MIXER || dispenser_type == DISPENSER_SYRINGE {
+          return invalid("%d ms is longer than dispenser %d can run in one go (max %d)", param, dispenser_id, p.MaxParam)
+        }
+        return invalid("parameter %d is out of range (must be from 0 to %d)", param, p.MaxParam)
+      }
+
+    default:
+      return invalid("unknown instruction")
+  }
+  return nil
+}
+
+// CheckDispenser checks barbot has a dispenser of dispenser_type (a dispenser_type.id) attached as dispenser_id.
+// D instructions only give the id, so one meant for another type of dispenser would run whatever is there.
+func (p DeviceProfile) CheckDispenser(dispenser_id int, dispenser_type int) error {
+  if dispenser_id < p.MinDispenserId || dispenser_id >= p.DispenserCount {
+    return fmt.Errorf("there's no dispenser %d (must be from %d to %d)", dispenser_id, p.MinDispenserId, p.DispenserCount - 1)
+  }
+
+  attached := p.DispenserType(dispenser_id)
+  if attached < 0 {
+    return fmt.Errorf("barbot has nothing attached as dispenser %d", dispenser_id)
+  }
+  if attached != dispenser_type {
+    return fmt.Errorf("barbot's dispenser %d is a %s, not a %s", dispenser_id, dispenserTypeName(attached), dispenserTypeName(dispenser_type))
+  }
+  return nil
+}
+
+// CheckInstructions checks every instruction in a list (but not whether they all fit in barbot's memory -
+// see Check)
+func (p DeviceProfile) CheckInstructions(cmdList []string) error {
+  for _, cmd := range cmdList {
+    if err := p.CheckInstruction(cmd); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Check checks every instruction in a list, and that they'll fit in barbot's memory
+func (p DeviceProfile) Check(cmdList []string) error {
+  if err := p.CheckInstructions(cmdList); err != nil {
+    return err
+  }
+
+  stored := 0
+  for _, cmd := range cmdList {
+    if storedInstruction(cmd) {
+      stored++
+    }
+  }
+  if stored > p.MaxInstructions {
+    return fmt.Errorf("too many instructions for barbot: %d (max %d)", stored, p.MaxInstructions)
+  }
+  return nil
+}
+
+// checkCommandList checks a list of instructions can be sent to barbot
+func checkCommandList(cmdList []string) error {
+  return BarbotProfile.Check(cmdList)
+}
+
+// splitCommandList splits a list of instructions ("C", stored instructions, "G") into batches that each fit
+// in barbot's memory, to be sent one after the other. Each batch starts with "C" and ends with "G".
+func splitCommandList(cmdList []string) [][]string {
+  var batches [][]string
+  batch := []string{"C"}
+  stored := 0
+
+  for _, cmd := range cmdList {
+    if cmd == "C" || cmd == "G" {
+      continue
+    }
+    if storedInstruction(cmd) {
+      if stored == MAX_INSTRUCTIONS {
+        batches = append(batches, append(batch, "G"))
+        batch = []string{"C"}
+        stored = 0
+      }
+      stored++
+    }
+    batch = append(batch, cmd)
+  }
+
+  return append(batches, append(batch, "G"))
+}
+
+// dispenserTypeName returns the name of a (non-manual) type of dispenser, as in the dispenser_type table
+func dispenserTypeName(dispenser_type int) string {
+  switch dispenser_type {
+    case DISPENSER_OPTIC:
+      return "Optic"
+    case DISPENSER_MIXER:
+      return "Mixer Tap"
+    case DISPENSER_DASHER:
+      return "Dasher"
+    case DISPENSER_SYRINGE:
+      return "Syringe"
+    case DISPENSER_CONVEYOR:
+      return "Conveyor"
+    case DISPENSER_STIRRER:
+      return "Stirrer"
+    case DISPENSER_SLICE:
+      return "Slice Dispenser"
+    case DISPENSER_UMBRELLA:
+      return "Umbrella Dropper"
+  }
+  return fmt.Sprintf("type %d", dispenser_type)
+}
+
+// firmwareDispenserType returns the type of dispenser barbot has attached as dispenser_id (see BarBot::BarBot()),
+// or -1 if nothing is attached.
+func firmwareDispenserType(dispenser_id int) int {
+  switch {
+    case dispenser_id >= 1 && dispenser_id <= 6:
+      return DISPENSER_OPTIC
+    case dispenser_id >= 7 && dispenser_id <= 12:
+      return DISPENSER_MIXER
+    case dispenser_id >= 13 && dispenser_id <= 15:
+      return DISPENSER_DASHER
+    case dispenser_id == 17:
+      return DISPENSER_CONVEYOR
+    case dispenser_id == 18:
+      return DISPENSER_SLICE
+    case dispenser_id == 19:
+      return DISPENSER_STIRRER
+    case dispenser_id == 20:
+      return DISPENSER_UMBRELLA
+  }
+  return -1
+}
+
+// dispenseDuration returns roughly how long a dispenser of dispenser_type takes to complete a D instruction with param
+func dispenseDuration(dispenser_type int, param int) time.Duration {
+  var ms int
+
+  switch dispenser_type {
+    case DISPENSER_OPTIC:
+      ms = OPTIC_DISPENSE_TIME
+    case DISPENSER_MIXER, DISPENSER_SYRINGE:
+      ms = param
+    case DISPENSER_DASHER:
+      ms = (param + 1) * DASHER_DASH_TIME
+      if ms > DASHER_TIMEOUT {
+        ms = DASHER_TIMEOUT
+      }
+    case DISPENSER_CONVEYOR:
+      ms = CONVEYOR_DISPENSE_TIME + CONVEYOR_REVERSE_TIME
+    case DISPENSER_SLICE:
+      ms = SLICE_PULSE + SLICE_TIME
+    case DISPENSER_STIRRER:
+      ms = STIRRER_PULSE + STIRRER_TIME
+    case DISPENSER_UMBRELLA:
+      ms = UMBRELLA_PULSE_LEN + UMBRELLA_WAIT
+  }
+
+  return time.Duration(ms) * time.Millisecond
+}
+
+// moveDuration returns how long the platform takes to travel distance steps, accelerating at
+// MAX_ACCEL up to a top speed of speed steps/sec, then decelerating to a stop.
+func moveDuration(distance int, speed int) time.Duration {
+  d := math.Abs(float64(distance))
+  v := float64(speed)
+  a := float64(MAX_ACCEL)
+  var secs float64
+
+  if d >= v*v/a {
+    // Reaches top speed
+    secs = d/v + v/a
+  } else {
+    // Accelerates half way, then decelerates
+    secs = 2 * math.Sqrt(d/a)
+  }
+
+  return time.Duration(secs * float64(time.Second))
+}
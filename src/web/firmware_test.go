@@ -0,0 +1,32 @@
+package main
+
+import (
+  "testing"
+)
+
+func TestCheckDispenser(t *testing.T) {
+  tests := []struct {
+    dispenser_id    int
+    dispenser_type  int
+    ok              bool
+  }{
+    {1, DISPENSER_OPTIC, true},
+    {7, DISPENSER_MIXER, true},
+    {13, DISPENSER_DASHER, true},
+    {17, DISPENSER_CONVEYOR, true},
+    {20, DISPENSER_UMBRELLA, true},
+    {17, DISPENSER_SYRINGE, false},   // The conveyor
+    {16, DISPENSER_SYRINGE, false},   // Nothing attached yet
+    {16, DISPENSER_CONVEYOR, false},
+    {7, DISPENSER_OPTIC, false},
+    {0, DISPENSER_OPTIC, false},
+    {DISPENSER_COUNT, DISPENSER_OPTIC, false},
+  }
+
+  for _, test := range tests {
+    err := BarbotProfile.CheckDispenser(test.dispenser_id, test.dispenser_type)
+    if (err == nil) != test.ok {
+      t.Errorf("CheckDispenser(%d, %s): got %v", test.dispenser_id, dispenserTypeName(test.dispenser_type), err)
+    }
+  }
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+  "bufio"
+  "errors"
+  "fmt"
+  "io"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  RECONNECT_MIN = 1 * time.Second   // Initial delay before trying to reopen the link
+  RECONNECT_MAX = 30 * time.Second  // Delay between attempts doubles each time, up to this
+)
+
+var ErrLinkDown = errors.New("not connected to barbot")
+
+// LinkStatus describes the health of the connection to barbot
+type LinkStatus struct {
+  Transport     string     `json:"transport"`
+  Connected     bool       `json:"connected"`
+  Since         time.Time  `json:"since"`          // When the link last went up/down
+  LastError     string     `json:"last_error,omitempty"`
+  Attempts      int        `json:"attempts"`       // Failed attempts to reconnect since the link went down
+  LastReceived  time.Time  `json:"last_received"`  // When a message was last received from barbot
+}
+
+// LinkMonitor keeps track of the link status, for display on the admin pages
+type LinkMonitor struct {
+  mu      sync.Mutex
+  status  LinkStatus
+}
+
+var BarbotLink = &LinkMonitor{}
+
+func (l *LinkMonitor) Snapshot() LinkStatus {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  return l.status
+}
+
+func (l *LinkMonitor) up(transport string) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  l.status.Transport = transport
+  l.status.Connected = true
+  l.status.Since = time.Now()
+  l.status.Attempts = 0
+}
+
+func (l *LinkMonitor) down(transport string, err error) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  if l.status.Connected || l.status.Since.IsZero() {
+    l.status.Since = time.Now()
+  } else {
+    l.status.Attempts++
+  }
+  l.status.Transport = transport
+  l.status.Connected = false
+  if err != nil {
+    l.status.LastError = err.Error()
+  }
+}
+
+func (l *LinkMonitor) received() {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+  l.status.LastReceived = time.Now()
+}
+
+// barbotSession is a single open connection to barbot
+type barbotSession struct {
+  port     io.ReadWriteCloser
+  lines    chan string
+  readErr  chan error
+  done     chan bool
+}
+
+// BBSerial goroutine manages communications with barbot, over whichever transport was selected.
+// If the link fails (e.g. USB cable pulled out) it keeps trying to reopen it; whilst the link
+// is down, any instructions sent are rejected with ErrLinkDown.
+func BBSerial(instructionList chan BarbotRequest, transport BarbotTransport) {
+  backoff := RECONNECT_MIN
+
+  for {
+    port, err := transport.Open()
+    if err != nil {
+      fmt.Printf("BBSerial: failed to open %s: %v. Retrying in %v\n", transport, err, backoff)
+      BarbotLink.down(transport.String(), err)
+      rejectRequests(instructionList, backoff)
+      backoff *= 2
+      if backoff > RECONNECT_MAX {
+        backoff = RECONNECT_MAX
+      }
+      continue
+    }
+
+    fmt.Printf("BBSerial: connected to %s\n", transport)
+    BarbotLink.up(transport.String())
+    backoff = RECONNECT_MIN
+
+    err = runSession(instructionList, port)
+
+    fmt.Printf("BBSerial: lost connection to %s: %v\n", transport, err)
+    port.Close()
+    BarbotLink.down(transport.String(), err)
+    BarbotMachine.Disconnected()
+    rejectRequests(instructionList, RECONNECT_MIN)
+  }
+}
+
+// rejectRequests fails any instructions sent whilst the link is down, until the wait is over
+func rejectRequests(instructionList chan BarbotRequest, wait time.Duration) {
+  timeout := time.After(wait)
+  for {
+    select {
+      case req := <-instructionList:
+        req.Result <- ErrLinkDown
+      case <-timeout:
+        return
+    }
+  }
+}
+
+// runSession sends instructions and processes messages from barbot until the link fails
+func runSession(instructionList chan BarbotRequest, port io.ReadWriteCloser) error {
+  seq := 0
+  session := &barbotSession{
+    port:     port,
+    lines:    make(chan string),
+    readErr:  make(chan error, 1),
+    done:     make(chan bool),
+  }
+  defer close(session.done)
+
+  // read from serial port
+  go func() {
+    reader := bufio.NewReader(port)
+
+    for {
+      buf, err := reader.ReadBytes('\n')
+      if err != nil {
+        session.readErr <- err
+        return
+      }
+      msg := strings.Trim(string(buf), "\r\n")
+      if len(msg) > 0 {
+        select {
+          case session.lines <- msg:
+          case <-session.done:
+            return
+        }
+      }
+    }
+  }()
+
+  // Find out what barbot is doing - it only reports its state when it changes
+  _, linkErr := session.send(BarbotRequest{Commands: []string{"S"}}, &seq)
+  if linkErr != nil {
+    return linkErr
+  }
+
+  for {
+    select {
+      case req := <-instructionList:
+        result, linkErr := session.send(req, &seq)
+        req.Result <- result
+        if linkErr != nil {
+          return linkErr
+        }
+
+      case recieced_msg := <-session.lines:
+        session.received(recieced_msg)
+
+      case err := <-session.readErr:
+        return err
+    }
+  }
+}
+
+// send transmits the instructions in req, stopping at the first one barbot doesn't accept.
+// Returns the result for the request, and an error if the link has failed.
+func (session *barbotSession) send(req BarbotRequest, seq *int) (result error, linkErr error) {
+  if req.OrderId > 0 {
+    BarbotMachine.SetOrder(req.OrderId, req.Batch, req.Batches)
+  }
+
+  for _, cmd := range req.Commands {
+    *seq = nextSeq(*seq)
+    fmt.Printf("> [%d] %s\n", *seq, cmd)
+    _, err := session.port.Write([]byte(formatCommand(*seq, cmd)))
+    if err != nil {
+      linkErr = err
+      result = fmt.Errorf("failed to transmit instruction [%s]: %v", cmd, err)
+      break
+    }
+
+    result, linkErr = session.waitForReply(*seq, cmd)
+    if result != nil {
+      // Don't send the rest of the list - barbot would only make part of the drink
+      break
+    }
+  }
+
+  if result != nil && req.OrderId > 0 {
+    BarbotMachine.SetOrder(0, 0, 0)
+  }
+  return result, linkErr
+}
+
+// waitForReply waits for barbot to acknowledge instruction seq. Returns nil if the instruction was
+// accepted, and an error if the link has failed.
+func (session *barbotSession) waitForReply(seq int, cmd string) (result error, linkErr error) {
+  timeout := time.After(REPLY_TIMEOUT)
+
+  for {
+    select {
+      case recieced_msg := <-session.lines:
+        reply, ok := session.received(recieced_msg)
+        if !ok || reply.Seq != seq {
+          // Not the reply we're waiting for (e.g. a late reply to an earlier instruction)
+          continue
+        }
+        if !reply.Ok {
+          return fmt.Errorf("barbot rejected instruction [%s]: %s", cmd, reply.Reason), nil
+        }
+        return nil, nil
+
+      case err := <-session.readErr:
+        return fmt.Errorf("lost connection to barbot whilst sending [%s]", cmd), err
+
+      case <-timeout:
+        return fmt.Errorf("no reply from barbot to instruction [%s]", cmd), nil
+    }
+  }
+}
+
+// received handles a message from barbot. If it's a reply to an instruction, it's returned.
+func (session *barbotSession) received(msg string) (BarbotReply, bool) {
+  fmt.Printf("< %s\n", msg)
+  BarbotLink.received()
+
+  reply, ok := parseReply(msg)
+  if !ok {
+    handleTelemetry(msg)
+  }
+  return reply, ok
+}
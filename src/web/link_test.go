@@ -0,0 +1,253 @@
+package main
+
+import (
+  "bufio"
+  "io"
+  "strconv"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+// fakeBarbot is a transport whose replies are scripted by the test
+type fakeBarbot struct {
+  respond   func(seq int, cmd string) []string  // What to send back when instruction seq is received
+  mu        sync.Mutex
+  received  []string                            // Instructions received, as "<seq> <instruction>"
+}
+
+type fakeConnection struct {
+  hostR  *io.PipeReader
+  hostW  *io.PipeWriter
+}
+
+func (c *fakeConnection) Read(p []byte) (int, error) {
+  return c.hostR.Read(p)
+}
+
+func (c *fakeConnection) Write(p []byte) (int, error) {
+  return c.hostW.Write(p)
+}
+
+func (c *fakeConnection) Close() error {
+  c.hostW.Close()
+  c.hostR.Close()
+  return nil
+}
+
+func (f *fakeBarbot) Open() (io.ReadWriteCloser, error) {
+  fakeR, hostW := io.Pipe()
+  hostR, fakeW := io.Pipe()
+
+  go func() {
+    defer fakeW.Close()
+    reader := bufio.NewReader(fakeR)
+    for {
+      buf, err := reader.ReadString('\n')
+      if err != nil {
+        return
+      }
+      msg := strings.TrimSpace(buf)
+      f.mu.Lock()
+      f.received = append(f.received, msg)
+      f.mu.Unlock()
+
+      fields := strings.SplitN(msg, " ", 2)
+      seq, _ := strconv.Atoi(fields[0])
+      for _, reply := range f.respond(seq, fields[1]) {
+        fakeW.Write([]byte(reply + "\r\n"))
+      }
+    }
+  }()
+
+  return &fakeConnection{hostR: hostR, hostW: hostW}, nil
+}
+
+func (f *fakeBarbot) String() string {
+  return "fake barbot"
+}
+
+func (f *fakeBarbot) Received() []string {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  return append([]string(nil), f.received...)
+}
+
+// okToEverything acknowledges every instruction
+func okToEverything(seq int, cmd string) []string {
+  return []string{"OK " + strconv.Itoa(seq)}
+}
+
+// startFakeSession runs a link session to f. Closing the returned connection ends it.
+func startFakeSession(t *testing.T, f *fakeBarbot) (chan BarbotRequest, io.Closer, chan error) {
+  port, err := f.Open()
+  if err != nil {
+    t.Fatalf("Open: %v", err)
+  }
+
+  instructionList := make(chan BarbotRequest)
+  ended := make(chan error, 1)
+  go func() {
+    ended <- runSession(instructionList, port)
+  }()
+  return instructionList, port, ended
+}
+
+func sendFake(instructionList chan BarbotRequest, cmds ...string) error {
+  req := BarbotRequest{Commands: cmds, Result: make(chan error, 1)}
+  instructionList <- req
+  return <-req.Result
+}
+
+func TestLinkReplies(t *testing.T) {
+  tests := []struct {
+    name     string
+    respond  func(seq int, cmd string) []string
+    err      string   // Expected result for "C", "M 100", "G" ("" for success)
+    sent     int      // How many of them should be sent
+  }{
+    {
+      "all ok",
+      okToEverything,
+      "",
+      3,
+    },
+    {
+      "rejected",
+      func(seq int, cmd string) []string {
+        if cmd == "M 100" {
+          return []string{"ERR " + strconv.Itoa(seq) + " instruction rejected"}
+        }
+        return okToEverything(seq, cmd)
+      },
+      "barbot rejected instruction [M 100]: instruction rejected",
+      2,
+    },
+    {
+      "telemetry and stale replies ignored",
+      func(seq int, cmd string) []string {
+        return []string{"S IDLE", "OK " + strconv.Itoa(seq + 100), "garbage", "OK " + strconv.Itoa(seq)}
+      },
+      "",
+      3,
+    },
+    {
+      "reply to another instruction's seq doesn't count",
+      func(seq int, cmd string) []string {
+        if cmd == "G" {
+          return []string{"ERR " + strconv.Itoa(seq - 1) + " busy", "OK " + strconv.Itoa(seq)}
+        }
+        return okToEverything(seq, cmd)
+      },
+      "",
+      3,
+    },
+  }
+
+  for _, test := range tests {
+    f := &fakeBarbot{respond: test.respond}
+    instructionList, port, _ := startFakeSession(t, f)
+
+    err := sendFake(instructionList, "C", "M 100", "G")
+    port.Close()
+
+    got := ""
+    if err != nil {
+      got = err.Error()
+    }
+    if got != test.err {
+      t.Errorf("%s: got error %q, expected %q", test.name, got, test.err)
+    }
+
+    // The S query sent on connecting, then the instructions
+    if received := f.Received(); len(received) != 1 + test.sent {
+      t.Errorf("%s: expected %d instructions sent, got %v", test.name, test.sent, received[1:])
+    }
+  }
+}
+
+func TestLinkSeq(t *testing.T) {
+  f := &fakeBarbot{respond: okToEverything}
+
+  // Sequence numbers start from 1 on each connection
+  for i := 0; i < 2; i++ {
+    f.mu.Lock()
+    f.received = nil
+    f.mu.Unlock()
+
+    instructionList, port, _ := startFakeSession(t, f)
+    if err := sendFake(instructionList, "C", "G"); err != nil {
+      t.Fatalf("send: %v", err)
+    }
+    port.Close()
+
+    expected := []string{"1 S", "2 C", "3 G"}
+    received := f.Received()
+    if strings.Join(received, ",") != strings.Join(expected, ",") {
+      t.Errorf("connection %d: got %v, expected %v", i + 1, received, expected)
+    }
+  }
+}
+
+func TestLinkTimeout(t *testing.T) {
+  var mu sync.Mutex
+  silent := true
+
+  f := &fakeBarbot{
+    respond: func(seq int, cmd string) []string {
+      mu.Lock()
+      defer mu.Unlock()
+      if cmd == "G" && silent {
+        return nil
+      }
+      if cmd == "C" && !silent {
+        // The late reply to the G that timed out arrives first
+        return []string{"OK " + strconv.Itoa(seq - 1), "ERR " + strconv.Itoa(seq) + " busy"}
+      }
+      return okToEverything(seq, cmd)
+    },
+  }
+  instructionList, port, ended := startFakeSession(t, f)
+  defer port.Close()
+
+  start := time.Now()
+  err := sendFake(instructionList, "C", "G")
+  if err == nil || err.Error() != "no reply from barbot to instruction [G]" {
+    t.Fatalf("expected a timeout for G, got %v", err)
+  }
+  if elapsed := time.Since(start); elapsed < REPLY_TIMEOUT {
+    t.Errorf("gave up after %v, before REPLY_TIMEOUT", elapsed)
+  }
+
+  // A timeout doesn't drop the link
+  select {
+    case err := <-ended:
+      t.Fatalf("session ended after a timeout: %v", err)
+    default:
+  }
+
+  // The late reply isn't taken as the reply to the next instruction
+  mu.Lock()
+  silent = false
+  mu.Unlock()
+  err = sendFake(instructionList, "C")
+  if err == nil || err.Error() != "barbot rejected instruction [C]: busy" {
+    t.Fatalf("expected C to be rejected, got %v", err)
+  }
+}
+
+func TestLinkLost(t *testing.T) {
+  f := &fakeBarbot{respond: okToEverything}
+  _, port, ended := startFakeSession(t, f)
+
+  port.Close()
+  select {
+    case err := <-ended:
+      if err == nil {
+        t.Errorf("session ended without an error")
+      }
+    case <-time.After(time.Second):
+      t.Fatalf("session still running after the connection closed")
+  }
+}
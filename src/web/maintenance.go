@@ -0,0 +1,149 @@
+package main
+
+import (
+  "database/sql"
+  "fmt"
+)
+
+/*
+ * Setting up and cleaning the machine, from the control admin page:
+ *
+ *   Test fire      - move to one dispenser and fire it once, with a chosen parameter (e.g. a single dash,
+ *                    N ms of mixer, one optic pull)
+ *   Prime mixers   - run every mixer for a short time, to fill the lines
+ *   Cleaning cycle - run every mixer and syringe for longer, to flush them through (with water connected)
+ *
+ * The instructions are built with dispenseCommands, the same as for drinks.
+ */
+
+const (
+  PRIME_MIXER_TIME  = 2000   // Default ms to run each mixer when priming
+  CLEAN_TIME        = 10000  // Default ms to run each mixer / syringe in the cleaning cycle
+)
+
+type MaintenanceDispenser struct {
+  Id            int
+  Name          string
+  TypeId        int
+  RailPosition  int
+  Param         int     // Default parameter to fire it with
+}
+
+// getMaintenanceDispensers returns the dispensers barbot can fire, with the parameter each would normally
+// be fired with (that of the ingredient loaded, if any)
+func getMaintenanceDispensers(db *sql.DB) []MaintenanceDispenser {
+  var dispensers []MaintenanceDispenser
+
+  sqlstr := `
+    select d.id, ifnull(d.name, ''), d.dispenser_type_id, d.rail_position, ifnull(i.dispenser_param, -1)
+    from dispenser d
+    inner join dispenser_type dt on dt.id = d.dispenser_type_id
+    left outer join ingredient i on i.id = d.ingredient_id
+    where dt.manual = 0
+    order by d.id`
+
+  rows, err := db.Query(sqlstr)
+  if err != nil {
+    panic(fmt.Sprintf("getMaintenanceDispensers failed: %v", err))
+  }
+  defer rows.Close()
+
+  for rows.Next() {
+    var dispenser MaintenanceDispenser
+    rows.Scan(&dispenser.Id, &dispenser.Name, &dispenser.TypeId, &dispenser.RailPosition, &dispenser.Param)
+    if dispenser.Param < 0 {
+      dispenser.Param = defaultTestParam(dispenser.TypeId)
+    }
+    dispensers = append(dispensers, dispenser)
+  }
+  return dispensers
+}
+
+// defaultTestParam returns the parameter to test fire an empty dispenser with. A dasher gives param+1
+// dashes, so 0 is a single dash; the other types (apart from mixers) don't use it.
+func defaultTestParam(dispenser_type int) int {
+  if dispenser_type == DISPENSER_MIXER || dispenser_type == DISPENSER_SYRINGE {
+    return PRIME_MIXER_TIME
+  }
+  return 0
+}
+
+// minTestParam returns the smallest parameter a dispenser can usefully be fired with: mixers are run for
+// param ms, so need at least 1
+func minTestParam(dispenser_type int) int {
+  if dispenser_type == DISPENSER_MIXER || dispenser_type == DISPENSER_SYRINGE {
+    return 1
+  }
+  return 0
+}
+
+// getTestFireCommands returns the instructions to fire a dispenser once. A param of less than 0 means use
+// the dispenser's default.
+func getTestFireCommands(db *sql.DB, dispenser_id int, param int) ([]string, error) {
+  for _, dispenser := range getMaintenanceDispensers(db) {
+    if dispenser.Id != dispenser_id {
+      continue
+    }
+    if err := BarbotProfile.CheckDispenser(dispenser.Id, dispenser.TypeId); err != nil {
+      return nil, fmt.Errorf("Can't fire %s: %v", dispenser.Name, err)
+    }
+    if param < 0 {
+      param = dispenser.Param
+    }
+    if min := minTestParam(dispenser.TypeId); param < min || param > MAX_PARAM {
+      return nil, fmt.Errorf("Parameter for %s must be from %d to %d", dispenser.Name, min, MAX_PARAM)
+    }
+
+    commandList := []string{"C"}
+    commandList = append(commandList, dispenseCommands(dispenser.RailPosition, dispenser.Id, dispenser.TypeId, 1, param)...)
+    commandList = append(commandList, "M 0", "G")
+    return commandList, nil
+  }
+
+  return nil, fmt.Errorf("Unknown dispenser %d", dispenser_id)
+}
+
+// getFlushCommands returns the instructions to run every dispenser of the given types for ms milliseconds.
+// Dispensers that barbot has as some other type (or doesn't have at all - e.g. there's no syringe yet) are
+// left out, rather than running whatever is attached with a time meant for a mixer.
+func getFlushCommands(db *sql.DB, ms int, dispenser_types ...int) ([]string, error) {
+  if ms <= 0 || ms > MAX_PARAM {
+    return nil, fmt.Errorf("Time must be from 1 to %d ms", MAX_PARAM)
+  }
+
+  commandList := []string{"C"}
+  for _, dispenser := range getMaintenanceDispensers(db) {
+    if BarbotProfile.DispenserType(dispenser.Id) != dispenser.TypeId {
+      continue
+    }
+    for _, dispenser_type := range dispenser_types {
+      if dispenser.TypeId == dispenser_type {
+        commandList = append(commandList, dispenseCommands(dispenser.RailPosition, dispenser.Id, dispenser.TypeId, 1, ms)...)
+      }
+    }
+  }
+  if len(commandList) == 1 {
+    return nil, fmt.Errorf("No dispensers to run")
+  }
+
+  commandList = append(commandList, "M 0", "G")
+  return commandList, nil
+}
+
+// getPrimeCommands returns the instructions to prime all the mixers
+func getPrimeCommands(db *sql.DB, ms int) ([]string, error) {
+  return getFlushCommands(db, ms, DISPENSER_MIXER)
+}
+
+// getCleaningCommands returns the instructions for the cleaning cycle
+func getCleaningCommands(db *sql.DB, ms int) ([]string, error) {
+  return getFlushCommands(db, ms, DISPENSER_MIXER, DISPENSER_SYRINGE)
+}
+
+// sendMaintenanceCommands sends instructions to barbot, as long as it's not doing anything else
+func sendMaintenanceCommands(cmdList []string) error {
+  if BarbotCalibration.Active() {
+    return fmt.Errorf("Finish calibrating first")
+  }
+  return BarbotDispatcher.SendWhenIdle(cmdList)
+}
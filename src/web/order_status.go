@@ -0,0 +1,188 @@
+package main
+
+import (
+  "database/sql"
+  "errors"
+  "fmt"
+  "time"
+)
+
+/*
+ * Order lifecycle. Every change of drink_order.status is checked against orderTransitions,
+ * and recorded in drink_order_status.
+ *
+ *   id-check-required -> queued          Alcoholic orders wait for the bartender to check ID
+ *   queued            -> ready           "Make" clicked (or picked up by auto mode); in the dispatcher queue
+ *   ready             -> dispatched      Instructions being sent to barbot
+ *   dispatched        -> waiting-for-glass / making
+ *   making            -> done / failed
+ *
+ * Orders can be cancelled until they've been dispatched. Failed orders can be made again, or cancelled.
+ */
+
+const (
+  ORDER_QUEUED            = "queued"
+  ORDER_ID_CHECK_REQUIRED = "id-check-required"
+  ORDER_READY             = "ready"
+  ORDER_DISPATCHED        = "dispatched"
+  ORDER_WAITING_FOR_GLASS = "waiting-for-glass"
+  ORDER_MAKING            = "making"
+  ORDER_DONE              = "done"
+  ORDER_FAILED            = "failed"
+  ORDER_CANCELLED         = "cancelled"
+)
+
+var orderTransitions = map[string][]string{
+  ORDER_ID_CHECK_REQUIRED: {ORDER_QUEUED, ORDER_CANCELLED},
+  ORDER_QUEUED:            {ORDER_READY, ORDER_CANCELLED},
+  ORDER_READY:             {ORDER_DISPATCHED, ORDER_FAILED, ORDER_CANCELLED},
+  ORDER_DISPATCHED:        {ORDER_WAITING_FOR_GLASS, ORDER_MAKING, ORDER_DONE, ORDER_FAILED},
+  ORDER_WAITING_FOR_GLASS: {ORDER_MAKING, ORDER_DONE, ORDER_FAILED},
+  ORDER_MAKING:            {ORDER_DONE, ORDER_FAILED},
+  ORDER_FAILED:            {ORDER_READY, ORDER_DONE, ORDER_CANCELLED},
+  ORDER_DONE:              {},
+  ORDER_CANCELLED:         {},
+}
+
+var ErrOrderNotFound = errors.New("order not found")
+
+// OrderTransitionError is returned by setOrderStatus if an order can't go to the requested status
+type OrderTransitionError struct {
+  OrderId  int
+  From     string
+  To       string
+}
+
+func (e *OrderTransitionError) Error() string {
+  return fmt.Sprintf("order %d is %s, so can't be %s", e.OrderId, e.From, e.To)
+}
+
+type OrderStatusChange struct {
+  Status  string     `json:"status"`
+  Time    time.Time  `json:"time"`
+  Reason  string     `json:"reason,omitempty"`
+}
+
+// orderTransitionAllowed checks if an order can go from status from to status to
+func orderTransitionAllowed(from string, to string) bool {
+  for _, allowed := range orderTransitions[from] {
+    if allowed == to {
+      return true
+    }
+  }
+  return false
+}
+
+// setOrderStatus moves an order to a new status, if that's a valid transition from its current status.
+// reason is recorded against the change (and in drink_order.fail_reason for failures).
+func setOrderStatus(db *sql.DB, drink_order_id int, status string, reason string) error {
+  tx, err := db.Begin()
+  if err != nil {
+    return err
+  }
+  defer tx.Rollback()
+
+  var current string
+  row := tx.QueryRow("select status from drink_order where id = ?", drink_order_id)
+  err = row.Scan(&current)
+  if err == sql.ErrNoRows {
+    return ErrOrderNotFound
+  }
+  if err != nil {
+    return err
+  }
+
+  if !orderTransitionAllowed(current, status) {
+    return &OrderTransitionError{OrderId: drink_order_id, From: current, To: status}
+  }
+
+  now := int32(time.Now().Unix())
+
+  _, err = tx.Exec("update drink_order set status = ?, status_ts = ? where id = ?", status, now, drink_order_id)
+  if err != nil {
+    return err
+  }
+
+  // Keep the older columns in step
+  switch status {
+    case ORDER_QUEUED:
+      _, err = tx.Exec("update drink_order set id_checked = 1 where id = ?", drink_order_id)
+    case ORDER_READY:
+      _, err = tx.Exec("update drink_order set fail_reason = null where id = ?", drink_order_id)
+    case ORDER_DISPATCHED:
+      _, err = tx.Exec("update drink_order set made_start_ts = ? where id = ?", now, drink_order_id)
+    case ORDER_DONE:
+      _, err = tx.Exec("update drink_order set made_end_ts = ? where id = ?", now, drink_order_id)
+    case ORDER_FAILED:
+      _, err = tx.Exec("update drink_order set fail_reason = ? where id = ?", reason, drink_order_id)
+    case ORDER_CANCELLED:
+      _, err = tx.Exec("update drink_order set cancelled = 1 where id = ?", drink_order_id)
+  }
+  if err != nil {
+    return err
+  }
+
+  err = recordOrderStatus(tx, drink_order_id, status, now, reason)
+  if err != nil {
+    return err
+  }
+
+  err = tx.Commit()
+  if err != nil {
+    return err
+  }
+
+  publishOrderEvent(db, drink_order_id, status)
+  return nil
+}
+
+// recordOrderStatus adds a status change to the order history
+func recordOrderStatus(tx *sql.Tx, drink_order_id int, status string, ts int32, reason string) error {
+  var reason_val interface{}
+  if reason != "" {
+    reason_val = reason
+  }
+  _, err := tx.Exec(
+    "insert into drink_order_status (drink_order_id, status, status_ts, reason) values (?, ?, ?, ?)",
+    drink_order_id,
+    status,
+    ts,
+    reason_val,
+  )
+  return err
+}
+
+// updateOrderStatus is setOrderStatus for use outside of a request handler; errors are logged rather than returned
+func updateOrderStatus(drink_order_id int, status string, reason string) {
+  db := getDBConnection()
+  defer db.Close()
+
+  err := setOrderStatus(db, drink_order_id, status, reason)
+  if err != nil {
+    fmt.Printf("updateOrderStatus: %v\n", err)
+  }
+}
+
+// getOrderHistory returns the status changes of an order, oldest first
+func getOrderHistory(db *sql.DB, drink_order_id int) []OrderStatusChange {
+  var history []OrderStatusChange
+
+  rows, err := db.Query(
+    "select status, status_ts, ifnull(reason, '') from drink_order_status where drink_order_id = ? order by status_ts, rowid",
+    drink_order_id,
+  )
+  if err != nil {
+    panic(fmt.Sprintf("getOrderHistory failed: %v", err))
+  }
+  defer rows.Close()
+
+  for rows.Next() {
+    var change OrderStatusChange
+    var ts int64
+    rows.Scan(&change.Status, &ts, &change.Reason)
+    change.Time = time.Unix(ts, 0)
+    history = append(history, change)
+  }
+
+  return history
+}
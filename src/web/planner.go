@@ -0,0 +1,325 @@
+package main
+
+import (
+  "database/sql"
+  "fmt"
+  "math"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+/*
+ * Travel planning. Ingredients are normally dispensed in recipe order (recipe_ingredient.seq), but
+ * consecutive ingredients with the same recipe_ingredient.step_group can go in any order - e.g. the
+ * spirits in a long island iced tea. planSteps reorders each group to keep the distance the platform
+ * travels down, then picks the nearest parking position (-parking) to finish at, rather than always
+ * going back to 0.
+ *
+ * Groups of up to PLAN_EXHAUSTIVE_MAX steps are planned by trying every order; bigger ones (which
+ * shouldn't really happen) by always going to the nearest next dispenser.
+ *
+ * An ingredient can be loaded in more than one dispenser (e.g. two vodka optics). Each ingredient is taken
+ * from the nearest one with enough left (empty ones are skipped), or if none has enough on its own, split
+ * between them.
+ */
+
+const PLAN_EXHAUSTIVE_MAX = 7
+
+// PlanStep is one ingredient of a drink, once it's been worked out which dispenser it'll come from
+type PlanStep struct {
+  IngredientId   int
+  DispenserId    int
+  DispenserType  int
+  RailPosition   int
+  Qty            int
+  Param          int
+  Group          int  // recipe_ingredient.step_group, or 0 if it has to stay where it is
+}
+
+// IngredientDispenser is a dispenser loaded with an ingredient
+type IngredientDispenser struct {
+  Id            int
+  RailPosition  int
+  Available     int  // Measures left (stock / unit_size), or -1 if its stock isn't tracked
+}
+
+// DispenserShare is how many measures of an ingredient to take from a dispenser
+type DispenserShare struct {
+  Dispenser  IngredientDispenser
+  Qty        int
+}
+
+var ParkingPositions = []int{0}  // Set by -parking
+
+// Where the platform was left after the last drink, so the next can be planned from there. -1 if it's not
+// known (after a fault), in which case the dispatcher re-zeroes barbot before the next drink.
+var parkedAt = 0
+var parkedAtMu sync.Mutex
+
+// parseParkingPositions parses the -parking flag, e.g. "0,7080"
+func parseParkingPositions(value string) ([]int, error) {
+  var positions []int
+  for _, field := range strings.Split(value, ",") {
+    position, err := strconv.Atoi(strings.TrimSpace(field))
+    if err != nil || position < 0 || position > MAX_RAIL_POSITION {
+      return nil, fmt.Errorf("invalid parking position %q (must be from 0 to %d)", field, MAX_RAIL_POSITION)
+    }
+    positions = append(positions, position)
+  }
+  return positions, nil
+}
+
+// getParkedAt returns where the platform was left after the last drink
+func getParkedAt() int {
+  parkedAtMu.Lock()
+  defer parkedAtMu.Unlock()
+  return parkedAt
+}
+
+// setParkedAt records where the platform will be left by instructions sent to barbot
+func setParkedAt(cmdList []string) {
+  parkedAtMu.Lock()
+  defer parkedAtMu.Unlock()
+
+  for _, cmd := range cmdList {
+    parkedAt = positionAfter(parkedAt, cmd)
+  }
+}
+
+// setParkedAtUnknown is called when barbot faults, as the platform may not be where barbot thinks it is
+func setParkedAtUnknown() {
+  parkedAtMu.Lock()
+  defer parkedAtMu.Unlock()
+  parkedAt = -1
+}
+
+// positionAfter returns where the platform will be once barbot has carried out cmd, starting from position
+// (-1 if not known). Only "Z" finds out where it really is.
+func positionAfter(position int, cmd string) int {
+  var target int
+
+  switch {
+    case cmd == "Z":
+      return ZERO_POSITION
+
+    case cmd == "R" && position >= 0:
+      // Reset moves back to 0
+      return 0
+
+    case position < 0:
+      return -1
+  }
+
+  if n, _ := fmt.Sscanf(cmd, "M %d", &target); n == 1 {
+    return target
+  }
+  return position
+}
+
+// getIngredientDispensers returns the dispensers loaded with an ingredient
+func getIngredientDispensers(db *sql.DB, ingredient_id int, unit_size int) []IngredientDispenser {
+  var dispensers []IngredientDispenser
+
+  if unit_size <= 0 {
+    unit_size = 1
+  }
+
+  rows, err := db.Query("select id, rail_position, ifnull(stock, -1) from dispenser where ingredient_id = ? order by id", ingredient_id)
+  if err != nil {
+    panic(fmt.Sprintf("getIngredientDispensers failed: %v", err))
+  }
+  defer rows.Close()
+
+  for rows.Next() {
+    var dispenser IngredientDispenser
+    var stock int
+    rows.Scan(&dispenser.Id, &dispenser.RailPosition, &stock)
+    dispenser.Available = -1
+    if stock >= 0 {
+      dispenser.Available = stock / unit_size
+    }
+    dispensers = append(dispensers, dispenser)
+  }
+  return dispensers
+}
+
+// allocateIngredient works out which dispensers to take qty measures from: the nearest to position with
+// enough left, or if none has, as much as possible from each (nearest first). used is the number of measures
+// already taken from each dispenser for this drink, and is updated. Returns nil if there isn't enough left.
+func allocateIngredient(dispensers []IngredientDispenser, qty int, position int, used map[int]int) []DispenserShare {
+  left := func(dispenser IngredientDispenser) int {
+    if dispenser.Available < 0 {
+      return math.MaxInt32
+    }
+    return dispenser.Available - used[dispenser.Id]
+  }
+
+  // Nearest first; if two are as near as each other (e.g. next to each other), the fuller one
+  candidates := append([]IngredientDispenser(nil), dispensers...)
+  sort.SliceStable(candidates, func(i, j int) bool {
+    di := abs(candidates[i].RailPosition - position)
+    dj := abs(candidates[j].RailPosition - position)
+    if di != dj {
+      return di < dj
+    }
+    return left(candidates[i]) > left(candidates[j])
+  })
+
+  for _, dispenser := range candidates {
+    if left(dispenser) >= qty {
+      used[dispenser.Id] += qty
+      return []DispenserShare{{dispenser, qty}}
+    }
+  }
+
+  var shares []DispenserShare
+  remaining := qty
+  for _, dispenser := range candidates {
+    take := left(dispenser)
+    if take <= 0 {
+      continue
+    }
+    if take > remaining {
+      take = remaining
+    }
+    shares = append(shares, DispenserShare{dispenser, take})
+    remaining -= take
+    if remaining == 0 {
+      break
+    }
+  }
+  if remaining > 0 {
+    return nil
+  }
+
+  for _, share := range shares {
+    used[share.Dispenser.Id] += share.Qty
+  }
+  return shares
+}
+
+// nearestParking returns the parking position closest to position
+func nearestParking(position int) int {
+  best := 0
+  for ix, park := range ParkingPositions {
+    if ix == 0 || abs(park - position) < abs(best - position) {
+      best = park
+    }
+  }
+  return best
+}
+
+// travelTime returns how long the platform spends moving to make steps (in order), starting from start and
+// ending at park
+func travelTime(steps []PlanStep, start int, park int) time.Duration {
+  var total time.Duration
+  position := start
+  for _, step := range steps {
+    total += moveDuration(step.RailPosition - position, SPEED_NORMAL)
+    position = step.RailPosition
+  }
+  return total + moveDuration(park - position, SPEED_NORMAL)
+}
+
+// planSteps reorders steps within their groups to cut down on travel, starting from start. Returns the
+// new order, and the parking position to finish at.
+func planSteps(steps []PlanStep, start int) ([]PlanStep, int) {
+  planned := make([]PlanStep, 0, len(steps))
+  position := start
+
+  for ix := 0; ix < len(steps); {
+    // Find the end of this group
+    end := ix + 1
+    if steps[ix].Group != 0 {
+      for end < len(steps) && steps[end].Group == steps[ix].Group {
+        end++
+      }
+    }
+
+    group := steps[ix:end]
+    if len(group) > 1 {
+      // Where to head for afterwards: the next step, or somewhere to park if this is the last group
+      next := -1
+      if end < len(steps) {
+        next = steps[end].RailPosition
+      }
+      group = planGroup(group, position, next)
+    }
+
+    planned = append(planned, group...)
+    position = planned[len(planned)-1].RailPosition
+    ix = end
+  }
+
+  return planned, nearestParking(position)
+}
+
+// planGroup returns the order of group with the least travel from start, to next (or the nearest parking
+// position if next is -1)
+func planGroup(group []PlanStep, start int, next int) []PlanStep {
+  cost := func(order []PlanStep) time.Duration {
+    end := next
+    if end < 0 {
+      end = nearestParking(order[len(order)-1].RailPosition)
+    }
+    return travelTime(order, start, end)
+  }
+
+  if len(group) > PLAN_EXHAUSTIVE_MAX {
+    return planNearest(group, start)
+  }
+
+  best := append([]PlanStep(nil), group...)
+  best_cost := cost(best)
+  order := append([]PlanStep(nil), group...)
+  permute(order, 0, func() {
+    if c := cost(order); c < best_cost {
+      best_cost = c
+      copy(best, order)
+    }
+  })
+  return best
+}
+
+// planNearest orders group by always going to the closest remaining dispenser
+func planNearest(group []PlanStep, start int) []PlanStep {
+  remaining := append([]PlanStep(nil), group...)
+  var order []PlanStep
+  position := start
+
+  for len(remaining) > 0 {
+    nearest := 0
+    for ix, step := range remaining {
+      if abs(step.RailPosition - position) < abs(remaining[nearest].RailPosition - position) {
+        nearest = ix
+      }
+    }
+    order = append(order, remaining[nearest])
+    position = remaining[nearest].RailPosition
+    remaining = append(remaining[:nearest], remaining[nearest+1:]...)
+  }
+  return order
+}
+
+// permute calls visit with steps in every possible order (from position k onwards)
+func permute(steps []PlanStep, k int, visit func()) {
+  if k == len(steps) {
+    visit()
+    return
+  }
+  for ix := k; ix < len(steps); ix++ {
+    steps[k], steps[ix] = steps[ix], steps[k]
+    permute(steps, k + 1, visit)
+    steps[k], steps[ix] = steps[ix], steps[k]
+  }
+}
+
+func abs(n int) int {
+  if n < 0 {
+    return -n
+  }
+  return n
+}
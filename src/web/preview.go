@@ -0,0 +1,194 @@
+package main
+
+import (
+  "database/sql"
+  "fmt"
+  "io"
+  "strings"
+  "time"
+)
+
+/*
+ * Previewing a drink: the instructions barbot would be sent to make it, where the platform would go, and
+ * roughly how long it would take - worked out without sending anything. Shown on the order list (for the
+ * size ordered) and on the recipe admin page.
+ *
+ * The -dry-run flag goes further, and runs the whole server without touching the serial port: instructions
+ * are logged, then handed to the simulator instead, so orders still go through the dispatcher as normal.
+ */
+
+// PreviewStop is one stop the platform makes along the rail
+type PreviewStop struct {
+  RailPosition  int
+  DispenserId   int     // 0 for the parking position at the end
+  Ingredient    string
+  Qty           int
+  Distance      int     // Steps travelled to get here
+  Move          string  // Time taken to get here
+  Dispense      string  // Time spent dispensing here
+}
+
+// DrinkPreview is what barbot would do to make a drink
+type DrinkPreview struct {
+  Commands    []string
+  Stops       []PreviewStop
+  Start       int            // Rail position the platform starts from (-1 if not known)
+  Distance    int            // Total steps travelled
+  Volume      int            // ml
+  Batches     int            // Number of batches the instructions will be sent in
+  Travel      string
+  Dispensing  string
+  Total       string
+  Duration    time.Duration
+  Error       string         // Why the drink can't be made, if it can't
+}
+
+// commandTimer works out roughly how long barbot takes to carry out instructions, using the firmware's
+// speeds and timings
+type commandTimer struct {
+  position    int
+  elapsed     time.Duration
+  travel      time.Duration
+  dispensing  time.Duration
+  opticUsed   map[int]time.Duration  // When each optic was last let go of
+}
+
+func newCommandTimer(start int) *commandTimer {
+  return &commandTimer{position: start, opticUsed: make(map[int]time.Duration)}
+}
+
+// run adds on the time taken by one instruction
+func (t *commandTimer) run(cmd string) {
+  var param1, param2 int
+
+  // How far the platform has to go - if it's not known where it is, assume the length of the rail
+  distance := func(to int) int {
+    if t.position < 0 {
+      return MAX_RAIL_POSITION
+    }
+    return to - t.position
+  }
+
+  if cmd == "Z" {
+    d := moveDuration(distance(ZERO_POSITION), SPEED_ZERO)
+    t.travel += d
+    t.elapsed += d
+  } else if cmd == "R" {
+    d := moveDuration(distance(0), SPEED_NORMAL)
+    t.travel += d
+    t.elapsed += d
+  } else if n, _ := fmt.Sscanf(cmd, "M %d", &param1); n == 1 {
+    d := moveDuration(distance(param1), SPEED_NORMAL)
+    t.travel += d
+    t.elapsed += d
+  } else if n, _ := fmt.Sscanf(cmd, "D %d %d", &param1, &param2); n == 2 {
+    dispenser_type := firmwareDispenserType(param1)
+
+    // An optic has to refill before it can be used again
+    if last, ok := t.opticUsed[param1]; ok && dispenser_type == DISPENSER_OPTIC {
+      if wait := OPTIC_RECHARGE_TIME * time.Millisecond - (t.elapsed - last); wait > 0 {
+        t.dispensing += wait
+        t.elapsed += wait
+      }
+    }
+
+    d := dispenseDuration(dispenser_type, param2)
+    t.dispensing += d
+    t.elapsed += d
+    if dispenser_type == DISPENSER_OPTIC {
+      t.opticUsed[param1] = t.elapsed
+    }
+  }
+
+  t.position = positionAfter(t.position, cmd)
+}
+
+// previewDrink works out how barbot would make a size of recipe_id, from wherever the platform is now
+func previewDrink(db *sql.DB, recipe_id int, size string) DrinkPreview {
+  var preview DrinkPreview
+  preview.Start = getParkedAt()
+
+  plan, err := getDrinkPlan(db, recipe_id, size, preview.Start, true)
+  if err != nil {
+    preview.Error = err.Error()
+  }
+  if plan.Commands == nil {
+    return preview
+  }
+
+  preview.Commands = plan.Commands
+  preview.Volume = plan.Volume
+  preview.Batches = len(splitCommandList(plan.Commands))
+
+  timer := newCommandTimer(preview.Start)
+  stop_at := func(stop PreviewStop, cmdList []string) {
+    stop.Distance = MAX_RAIL_POSITION
+    if timer.position >= 0 {
+      stop.Distance = abs(stop.RailPosition - timer.position)
+    }
+    travel, dispensing := timer.travel, timer.dispensing
+    for _, cmd := range cmdList {
+      timer.run(cmd)
+    }
+    stop.Move = formatSeconds(timer.travel - travel)
+    stop.Dispense = formatSeconds(timer.dispensing - dispensing)
+    preview.Distance += stop.Distance
+    preview.Stops = append(preview.Stops, stop)
+  }
+
+  // If the platform's been lost, the dispatcher zeroes barbot first
+  if preview.Start < 0 {
+    stop_at(PreviewStop{RailPosition: ZERO_POSITION, Ingredient: "(zero)"}, []string{"Z"})
+  }
+
+  for _, step := range plan.Steps {
+    stop := PreviewStop{RailPosition: step.RailPosition, DispenserId: step.DispenserId, Ingredient: getIngredientName(db, step.IngredientId), Qty: step.Qty}
+    stop_at(stop, dispenseCommands(step.RailPosition, step.DispenserId, step.DispenserType, step.Qty, step.Param))
+  }
+  stop_at(PreviewStop{RailPosition: plan.Park, Ingredient: "(park)"}, []string{fmt.Sprintf("M %d", plan.Park)})
+
+  preview.Travel = formatSeconds(timer.travel)
+  preview.Dispensing = formatSeconds(timer.dispensing)
+  preview.Total = formatSeconds(timer.elapsed)
+  preview.Duration = timer.elapsed
+  return preview
+}
+
+// getIngredientName returns the name of an ingredient
+func getIngredientName(db *sql.DB, ingredient_id int) string {
+  var name string
+  row := db.QueryRow("select name from ingredient where id = ?", ingredient_id)
+  if err := row.Scan(&name); err != nil {
+    return fmt.Sprintf("Ingredient %d", ingredient_id)
+  }
+  return name
+}
+
+func formatSeconds(d time.Duration) string {
+  return fmt.Sprintf("%.1fs", d.Seconds())
+}
+
+// DryRunTransport is used in place of the selected transport when running with -dry-run. Nothing is sent to
+// barbot: instructions are logged, then passed to the simulator so the server carries on as normal.
+type DryRunTransport struct {
+  Instead  BarbotTransport  // What would have been used
+  Sim      *BarbotSimulator
+}
+
+type dryRunPort struct {
+  io.ReadWriteCloser
+}
+
+func (t *DryRunTransport) Open() (io.ReadWriteCloser, error) {
+  return &dryRunPort{t.Sim.Connect()}, nil
+}
+
+func (t *DryRunTransport) String() string {
+  return fmt.Sprintf("dry run (simulator, instead of %s)", t.Instead)
+}
+
+// Write logs an instruction rather than sending it to barbot
+func (p *dryRunPort) Write(b []byte) (int, error) {
+  fmt.Printf("DRY RUN: not sending %s\n", strings.TrimSpace(string(b)))
+  return p.ReadWriteCloser.Write(b)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+  "fmt"
+  "strconv"
+  "strings"
+  "time"
+)
+
+/*
+ * Serial protocol between the web server and barbot:
+ *
+ *   Pi -> barbot:  <seq> <instruction> [param1] [param2]
+ *   barbot -> Pi:  OK <seq>
+ *                  ERR <seq> <reason>
+ *
+ * Every instruction sent gets exactly one OK/ERR reply, echoing the sequence number. Sequence numbers
+ * start from 1 each time the link is opened, and wrap back to 1 after MAX_SEQ.
+ * Anything else received from barbot is not a reply.
+ */
+
+const REPLY_TIMEOUT = 2 * time.Second // How long to wait for barbot to acknowledge an instruction
+const MAX_SEQ = MAX_PARAM               // barbot reads the sequence number as a uint16_t, so it wraps after this
+
+// BarbotRequest is a list of instructions to be sent to barbot. The outcome (nil if every
+// instruction was acknowledged) is sent back on Result.
+type BarbotRequest struct {
+  OrderId   int       // drink_order.id being made, or 0 for control instructions
+  Batch     int       // For long orders sent in several batches (see splitCommandList), which one this is...
+  Batches   int       // ...out of how many
+  Commands  []string
+  Result    chan error
+}
+
+type BarbotReply struct {
+  Seq     int
+  Ok      bool
+  Reason  string
+}
+
+// nextSeq returns the sequence number to use after seq: 1 to MAX_SEQ, then back to 1
+func nextSeq(seq int) int {
+  return seq % MAX_SEQ + 1
+}
+
+// formatCommand prefixes an instruction with its sequence number, ready to be transmitted
+func formatCommand(seq int, cmd string) string {
+  return fmt.Sprintf("%d %s\n", seq, cmd)
+}
+
+// parseReply checks if msg is an OK/ERR reply, and if so returns the decoded reply
+func parseReply(msg string) (BarbotReply, bool) {
+  var reply BarbotReply
+
+  fields := strings.SplitN(msg, " ", 3)
+  if len(fields) < 2 {
+    return reply, false
+  }
+
+  switch fields[0] {
+    case "OK":
+      reply.Ok = true
+    case "ERR":
+      reply.Ok = false
+      if len(fields) > 2 {
+        reply.Reason = fields[2]
+      }
+    default:
+      return reply, false
+  }
+
+  seq, err := strconv.Atoi(fields[1])
+  if err != nil {
+    return reply, false
+  }
+  reply.Seq = seq
+
+  return reply, true
+}
+
+// sendCommands passes cmdList to the BBSerial goroutine and waits for the result
+func sendCommands(cmdList []string) error {
+  return sendOrderCommands(0, cmdList)
+}
+
+// sendOrderCommands sends the instructions to make drink_order_id, and waits for the result
+func sendOrderCommands(drink_order_id int, cmdList []string) error {
+  return sendOrderBatch(drink_order_id, 1, 1, cmdList)
+}
+
+// sendOrderBatch sends one batch of the instructions to make drink_order_id, and waits for the result
+func sendOrderBatch(drink_order_id int, batch int, batches int, cmdList []string) error {
+  if err := checkCommandList(cmdList); err != nil {
+    return err
+  }
+
+  req := BarbotRequest{OrderId: drink_order_id, Batch: batch, Batches: batches, Commands: cmdList, Result: make(chan error, 1)}
+  BarbotSerialChan <- req
+  err := <-req.Result
+  if err == nil {
+    setParkedAt(cmdList)
+  }
+  return err
+}
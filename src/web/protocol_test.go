@@ -0,0 +1,93 @@
+package main
+
+import (
+  "testing"
+)
+
+func TestParseReply(t *testing.T) {
+  tests := []struct {
+    msg    string
+    ok     bool
+    reply  BarbotReply
+  }{
+    {"OK 1", true, BarbotReply{Seq: 1, Ok: true}},
+    {"OK 65535", true, BarbotReply{Seq: 65535, Ok: true}},
+    {"ERR 7 busy", true, BarbotReply{Seq: 7, Ok: false, Reason: "busy"}},
+    {"ERR 12 parameter missing", true, BarbotReply{Seq: 12, Ok: false, Reason: "parameter missing"}},
+    {"ERR 3", true, BarbotReply{Seq: 3, Ok: false}},
+    {"OK", false, BarbotReply{}},
+    {"ERR", false, BarbotReply{}},
+    {"OK x", false, BarbotReply{}},
+    {"ERR x busy", false, BarbotReply{}},
+    {"ok 1", false, BarbotReply{}},
+    {"S IDLE", false, BarbotReply{}},
+    {"", false, BarbotReply{}},
+  }
+
+  for _, test := range tests {
+    reply, ok := parseReply(test.msg)
+    if ok != test.ok {
+      t.Errorf("parseReply(%q): got ok=%v, expected %v", test.msg, ok, test.ok)
+      continue
+    }
+    if ok && reply != test.reply {
+      t.Errorf("parseReply(%q): got %+v, expected %+v", test.msg, reply, test.reply)
+    }
+  }
+}
+
+func TestParseTelemetry(t *testing.T) {
+  tests := []struct {
+    msg     string
+    ok      bool
+    state   string
+    reason  string
+  }{
+    {"S IDLE", true, STATE_IDLE, ""},
+    {"S WAITING", true, STATE_WAITING, ""},
+    {"S RUNNING", true, STATE_RUNNING, ""},
+    {"S FAULT glass removed", true, STATE_FAULT, "glass removed"},
+    {"S FAULT reset", true, STATE_FAULT, "reset"},
+    {"S UNKNOWN", false, "", ""},   // Only the web server uses UNKNOWN
+    {"S BOGUS", false, "", ""},
+    {"S", false, "", ""},
+    {"OK 1", false, "", ""},
+    {"IDLE", false, "", ""},
+    {"", false, "", ""},
+  }
+
+  for _, test := range tests {
+    state, reason, ok := parseTelemetry(test.msg)
+    if ok != test.ok {
+      t.Errorf("parseTelemetry(%q): got ok=%v, expected %v", test.msg, ok, test.ok)
+      continue
+    }
+    if ok && (state != test.state || reason != test.reason) {
+      t.Errorf("parseTelemetry(%q): got %q %q, expected %q %q", test.msg, state, reason, test.state, test.reason)
+    }
+  }
+}
+
+func TestNextSeq(t *testing.T) {
+  tests := []struct {
+    seq   int
+    next  int
+  }{
+    {0, 1},   // First instruction on a new link
+    {1, 2},
+    {MAX_SEQ - 1, MAX_SEQ},
+    {MAX_SEQ, 1},
+  }
+
+  for _, test := range tests {
+    if next := nextSeq(test.seq); next != test.next {
+      t.Errorf("nextSeq(%d): got %d, expected %d", test.seq, next, test.next)
+    }
+  }
+}
+
+func TestFormatCommand(t *testing.T) {
+  if cmd := formatCommand(42, "D 7 50"); cmd != "42 D 7 50\n" {
+    t.Errorf("formatCommand: got %q", cmd)
+  }
+}
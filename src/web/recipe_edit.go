@@ -0,0 +1,202 @@
+package main
+
+import (
+  "database/sql"
+  "errors"
+  "fmt"
+  "strings"
+)
+
+/*
+ * Editing recipes from the recipe admin page: reordering ingredients (barbot dispenses them in
+ * recipe_ingredient.seq order), changing quantities, renaming, deleting and cloning recipes.
+ */
+
+var ErrRecipeInUse = errors.New("Recipe has orders waiting to be made (or failed) - make or cancel them first")
+var ErrRecipeExists = errors.New("There's already a recipe with that name")
+
+// moveRecipeIngredient swaps an ingredient with the one before it (up) or after it (down)
+func moveRecipeIngredient(db *sql.DB, recipe_id int, ingredient_id int, up bool) error {
+  tx, err := db.Begin()
+  if err != nil {
+    return err
+  }
+  defer tx.Rollback()
+
+  var seq int
+  row := tx.QueryRow("select seq from recipe_ingredient where recipe_id = ? and ingredient_id = ?", recipe_id, ingredient_id)
+  if err = row.Scan(&seq); err != nil {
+    return err
+  }
+
+  sqlstr := "select ingredient_id, seq from recipe_ingredient where recipe_id = ? and seq > ? order by seq limit 1"
+  if up {
+    sqlstr = "select ingredient_id, seq from recipe_ingredient where recipe_id = ? and seq < ? order by seq desc limit 1"
+  }
+
+  var other_id int
+  var other_seq int
+  row = tx.QueryRow(sqlstr, recipe_id, seq)
+  err = row.Scan(&other_id, &other_seq)
+  if err == sql.ErrNoRows {
+    // Already first / last
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+
+  // (recipe_id, seq) is unique, so move one out of the way first
+  updates := []struct{ id, seq int }{{ingredient_id, -1}, {other_id, seq}, {ingredient_id, other_seq}}
+  for _, u := range updates {
+    _, err = tx.Exec("update recipe_ingredient set seq = ? where recipe_id = ? and ingredient_id = ?", u.seq, recipe_id, u.id)
+    if err != nil {
+      return err
+    }
+  }
+
+  return tx.Commit()
+}
+
+// setRecipeQuantities changes the quantities of ingredients in a recipe (ingredient_id -> qty). Nothing is
+// changed if it would make more than the glass holds (unless it's less than there was already).
+func setRecipeQuantities(db *sql.DB, recipe_id int, qtys map[int]int) error {
+  volume, glass_ml := getRecipeVolume(db, recipe_id)
+  new_volume := volume
+
+  for ingredient_id, qty := range qtys {
+    var old_qty int
+    row := db.QueryRow("select qty from recipe_ingredient where recipe_id = ? and ingredient_id = ?", recipe_id, ingredient_id)
+    if err := row.Scan(&old_qty); err != nil {
+      return err
+    }
+    new_volume += getIngredientVolume(db, ingredient_id, qty) - getIngredientVolume(db, ingredient_id, old_qty)
+  }
+
+  if glass_ml > 0 && new_volume > glass_ml && new_volume > volume {
+    return fmt.Errorf("Not saved - that would make %dml, but the glass only holds %dml", new_volume, glass_ml)
+  }
+
+  tx, err := db.Begin()
+  if err != nil {
+    return err
+  }
+  defer tx.Rollback()
+
+  for ingredient_id, qty := range qtys {
+    _, err = tx.Exec("update recipe_ingredient set qty = ? where recipe_id = ? and ingredient_id = ?", qty, recipe_id, ingredient_id)
+    if err != nil {
+      return err
+    }
+  }
+  return tx.Commit()
+}
+
+// renameRecipe changes the name and glass of a recipe
+func renameRecipe(db *sql.DB, recipe_id int, name string, glass_type_id int) error {
+  name = strings.TrimSpace(name)
+  if name == "" {
+    return errors.New("Recipe name can't be blank")
+  }
+  if recipeNameTaken(db, name, recipe_id) {
+    return ErrRecipeExists
+  }
+
+  _, err := db.Exec("update recipe set name = ?, glass_type_id = ? where id = ?", name, glass_type_id, recipe_id)
+  return err
+}
+
+// deleteRecipe removes a recipe, as long as there are no orders for it still to be made. Failed orders count,
+// as they can be made again.
+func deleteRecipe(db *sql.DB, recipe_id int) error {
+  var pending int
+  row := db.QueryRow(
+    "select count(*) from drink_order where recipe_id = ? and status not in (?, ?)",
+    recipe_id,
+    ORDER_DONE,
+    ORDER_CANCELLED,
+  )
+  if err := row.Scan(&pending); err != nil {
+    return err
+  }
+  if pending > 0 {
+    return ErrRecipeInUse
+  }
+
+  tx, err := db.Begin()
+  if err != nil {
+    return err
+  }
+  defer tx.Rollback()
+
+  for _, sqlstr := range []string{
+    "delete from recipe_ingredient where recipe_id = ?",
+    "delete from recipe_tag where recipe_id = ?",
+    "delete from recipe where id = ?",
+  } {
+    if _, err = tx.Exec(sqlstr, recipe_id); err != nil {
+      return err
+    }
+  }
+
+  return tx.Commit()
+}
+
+// cloneRecipe copies a recipe (with its ingredients and tags) to a new one, and returns the new recipe's id
+func cloneRecipe(db *sql.DB, recipe_id int, name string) (int, error) {
+  name = strings.TrimSpace(name)
+  if name == "" {
+    var orig_name string
+    row := db.QueryRow("select name from recipe where id = ?", recipe_id)
+    if err := row.Scan(&orig_name); err != nil {
+      return -1, err
+    }
+    name = fmt.Sprintf("%s (copy)", orig_name)
+  }
+  if recipeNameTaken(db, name, -1) {
+    return -1, ErrRecipeExists
+  }
+
+  tx, err := db.Begin()
+  if err != nil {
+    return -1, err
+  }
+  defer tx.Rollback()
+
+  result, err := tx.Exec("insert into recipe (name, glass_type_id) select ?, glass_type_id from recipe where id = ?", name, recipe_id)
+  if err != nil {
+    return -1, err
+  }
+  id, err := result.LastInsertId()
+  if err != nil {
+    return -1, err
+  }
+  new_id := int(id)
+
+  _, err = tx.Exec(`
+    insert into recipe_ingredient (recipe_id, ingredient_id, seq, qty, dispenser_param, step_group)
+    select ?, ingredient_id, seq, qty, dispenser_param, step_group from recipe_ingredient where recipe_id = ?`,
+    new_id,
+    recipe_id,
+  )
+  if err != nil {
+    return -1, err
+  }
+
+  _, err = tx.Exec("insert into recipe_tag (recipe_id, tag) select ?, tag from recipe_tag where recipe_id = ?", new_id, recipe_id)
+  if err != nil {
+    return -1, err
+  }
+
+  return new_id, tx.Commit()
+}
+
+// recipeNameTaken checks if a recipe other than recipe_id already has a name (ignoring case)
+func recipeNameTaken(db *sql.DB, name string, recipe_id int) bool {
+  var count int
+  row := db.QueryRow("select count(*) from recipe where lower(name) = lower(?) and id != ?", name, recipe_id)
+  if err := row.Scan(&count); err != nil {
+    panic(fmt.Sprintf("recipeNameTaken failed: %v", err))
+  }
+  return count > 0
+}
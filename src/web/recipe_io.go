@@ -0,0 +1,472 @@
+package main
+
+import (
+  "bytes"
+  "database/sql"
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "sort"
+  "strings"
+
+  "gopkg.in/yaml.v2"
+)
+
+/*
+ * Recipe import / export, so the menu can be kept in version control rather than typed in through the
+ * admin pages. Files are JSON or YAML:
+ *
+ *   recipes:
+ *     - name: Gin and Tonic
+ *       glass: Highball
+ *       tags: [classic, gin]
+ *       ingredients:
+ *         - name: Gin
+ *           qty: 1
+ *         - name: Tonic Water
+ *           qty: 150
+ *
+ * qty is the same as recipe_ingredient.qty (e.g. number of optic measures, or ml for mixers), and
+ * ingredients are dispensed in the order listed - apart from consecutive ingredients with the same
+ * (optional) group number, which can be dispensed in any order. Ingredient and glass names are matched to the database
+ * ignoring case.
+ *
+ * Importing adds recipes that aren't in the database, and replaces the glass, ingredients and tags of those
+ * that are (matched by name). Recipes not in the file are left alone, so importing the same file twice
+ * changes nothing. If anything in the file doesn't match (e.g. an unknown ingredient), nothing is imported.
+ */
+
+type RecipeFile struct {
+  Recipes  []RecipeDef  `json:"recipes" yaml:"recipes"`
+}
+
+type RecipeDef struct {
+  Name         string                 `json:"name" yaml:"name"`
+  Glass        string                 `json:"glass" yaml:"glass"`
+  Tags         []string               `json:"tags,omitempty" yaml:"tags,omitempty"`
+  Ingredients  []RecipeDefIngredient  `json:"ingredients" yaml:"ingredients"`
+}
+
+type RecipeDefIngredient struct {
+  Name            string  `json:"name" yaml:"name"`
+  Qty             int     `json:"qty" yaml:"qty"`
+  DispenserParam  *int    `json:"dispenser_param,omitempty" yaml:"dispenser_param,omitempty"`
+  Group           *int    `json:"group,omitempty" yaml:"group,omitempty"`
+}
+
+// ImportReport says what an import did (or, for a dry run, would do)
+type ImportReport struct {
+  DryRun              bool
+  Created             []string
+  Updated             []string
+  Unchanged           []string
+  UnknownIngredients  []string  // "<recipe>: <ingredient>"
+  Errors              []string
+}
+
+func (report ImportReport) Ok() bool {
+  return len(report.UnknownIngredients) == 0 && len(report.Errors) == 0
+}
+
+func (report ImportReport) String() string {
+  var buf bytes.Buffer
+  if report.DryRun {
+    fmt.Fprintf(&buf, "Dry run - nothing has been changed\n")
+  }
+  for _, s := range report.Created {
+    fmt.Fprintf(&buf, "  new:       %s\n", s)
+  }
+  for _, s := range report.Updated {
+    fmt.Fprintf(&buf, "  updated:   %s\n", s)
+  }
+  for _, s := range report.Unchanged {
+    fmt.Fprintf(&buf, "  unchanged: %s\n", s)
+  }
+  for _, s := range report.UnknownIngredients {
+    fmt.Fprintf(&buf, "  unknown ingredient - %s\n", s)
+  }
+  for _, s := range report.Errors {
+    fmt.Fprintf(&buf, "  error - %s\n", s)
+  }
+  return buf.String()
+}
+
+// exportRecipes returns every recipe in the database, in name order
+func exportRecipes(db *sql.DB) RecipeFile {
+  var file RecipeFile
+
+  rows, err := db.Query(`
+    select r.id, r.name, ifnull(gt.name, '')
+    from recipe r
+    left outer join glass_type gt on gt.id = r.glass_type_id
+    order by r.name`)
+  if err != nil {
+    panic(fmt.Sprintf("exportRecipes failed: %v", err))
+  }
+  defer rows.Close()
+
+  var ids []int
+  for rows.Next() {
+    var id int
+    var recipe RecipeDef
+    rows.Scan(&id, &recipe.Name, &recipe.Glass)
+    ids = append(ids, id)
+    file.Recipes = append(file.Recipes, recipe)
+  }
+  rows.Close()
+
+  for ix, id := range ids {
+    file.Recipes[ix].Ingredients = getRecipeDefIngredients(db, id)
+    file.Recipes[ix].Tags = getRecipeTags(db, id)
+  }
+
+  return file
+}
+
+func getRecipeDefIngredients(db *sql.DB, recipe_id int) []RecipeDefIngredient {
+  var ingredients []RecipeDefIngredient
+
+  rows, err := db.Query(`
+    select i.name, ri.qty, ri.dispenser_param, ri.step_group
+    from recipe_ingredient ri
+    inner join ingredient i on i.id = ri.ingredient_id
+    where ri.recipe_id = ?
+    order by ri.seq`, recipe_id)
+  if err != nil {
+    panic(fmt.Sprintf("getRecipeDefIngredients failed: %v", err))
+  }
+  defer rows.Close()
+
+  for rows.Next() {
+    var ingr RecipeDefIngredient
+    var dispenser_param sql.NullInt64
+    var step_group sql.NullInt64
+    rows.Scan(&ingr.Name, &ingr.Qty, &dispenser_param, &step_group)
+    if dispenser_param.Valid {
+      param := int(dispenser_param.Int64)
+      ingr.DispenserParam = &param
+    }
+    if step_group.Valid {
+      group := int(step_group.Int64)
+      ingr.Group = &group
+    }
+    ingredients = append(ingredients, ingr)
+  }
+
+  return ingredients
+}
+
+// getRecipeTags returns the tags of a recipe, in alphabetical order
+func getRecipeTags(db *sql.DB, recipe_id int) []string {
+  var tags []string
+
+  rows, err := db.Query("select tag from recipe_tag where recipe_id = ? order by tag", recipe_id)
+  if err != nil {
+    panic(fmt.Sprintf("getRecipeTags failed: %v", err))
+  }
+  defer rows.Close()
+
+  for rows.Next() {
+    var tag string
+    rows.Scan(&tag)
+    tags = append(tags, tag)
+  }
+
+  return tags
+}
+
+// encodeRecipes writes recipes out as "json" or "yaml"
+func encodeRecipes(file RecipeFile, format string) ([]byte, error) {
+  switch format {
+    case "json":
+      return json.MarshalIndent(file, "", "  ")
+    case "yaml", "yml":
+      return yaml.Marshal(file)
+  }
+  return nil, fmt.Errorf("unknown format %s - should be json or yaml", format)
+}
+
+// decodeRecipes reads a JSON or YAML recipe file
+func decodeRecipes(data []byte) (RecipeFile, error) {
+  var file RecipeFile
+  var err error
+
+  if strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+    err = json.Unmarshal(data, &file)
+  } else {
+    err = yaml.Unmarshal(data, &file)
+  }
+  return file, err
+}
+
+// importRecipes adds / updates the recipes in file. With dry_run set, nothing is changed, but the
+// report says what would have been.
+func importRecipes(db *sql.DB, file RecipeFile, dry_run bool) ImportReport {
+  report := ImportReport{DryRun: dry_run}
+
+  ingredient_ids := getNameLookup(db, "select id, name from ingredient")
+  glass_ids := getNameLookup(db, "select id, name from glass_type")
+  recipe_ids := getNameLookup(db, "select id, name from recipe")
+
+  // Check everything matches before changing anything
+  seen := make(map[string]bool)
+  for ix, recipe := range file.Recipes {
+    recipe.Name = strings.TrimSpace(recipe.Name)
+    if recipe.Name == "" {
+      report.Errors = append(report.Errors, fmt.Sprintf("recipe %d has no name", ix + 1))
+      continue
+    }
+    if seen[strings.ToLower(recipe.Name)] {
+      report.Errors = append(report.Errors, fmt.Sprintf("%s: listed more than once", recipe.Name))
+    }
+    seen[strings.ToLower(recipe.Name)] = true
+
+    if _, ok := glass_ids[strings.ToLower(strings.TrimSpace(recipe.Glass))]; !ok {
+      report.Errors = append(report.Errors, fmt.Sprintf("%s: unknown glass \"%s\"", recipe.Name, recipe.Glass))
+    }
+    if len(recipe.Ingredients) == 0 {
+      report.Errors = append(report.Errors, fmt.Sprintf("%s: no ingredients", recipe.Name))
+    }
+
+    in_recipe := make(map[int]bool)
+    for _, ingr := range recipe.Ingredients {
+      id, ok := ingredient_ids[strings.ToLower(strings.TrimSpace(ingr.Name))]
+      if !ok {
+        report.UnknownIngredients = append(report.UnknownIngredients, fmt.Sprintf("%s: %s", recipe.Name, ingr.Name))
+        continue
+      }
+      if in_recipe[id] {
+        report.Errors = append(report.Errors, fmt.Sprintf("%s: %s is listed more than once", recipe.Name, ingr.Name))
+      }
+      in_recipe[id] = true
+      if ingr.Qty <= 0 {
+        report.Errors = append(report.Errors, fmt.Sprintf("%s: quantity of %s should be more than 0", recipe.Name, ingr.Name))
+      }
+    }
+  }
+
+  if !report.Ok() {
+    report.DryRun = true
+    return report
+  }
+
+  // Work out what needs changing
+  var changes []RecipeDef
+  for _, recipe := range file.Recipes {
+    recipe.Name = strings.TrimSpace(recipe.Name)
+    recipe_id, exists := recipe_ids[strings.ToLower(recipe.Name)]
+
+    if !exists {
+      report.Created = append(report.Created, recipe.Name)
+    } else if recipeUnchanged(db, recipe_id, recipe) {
+      report.Unchanged = append(report.Unchanged, recipe.Name)
+      continue
+    } else {
+      report.Updated = append(report.Updated, recipe.Name)
+    }
+    changes = append(changes, recipe)
+  }
+
+  if dry_run || len(changes) == 0 {
+    return report
+  }
+
+  tx, err := db.Begin()
+  if err != nil {
+    report.Errors = append(report.Errors, err.Error())
+    report.DryRun = true
+    return report
+  }
+  defer tx.Rollback()
+
+  for _, recipe := range changes {
+    recipe_id, exists := recipe_ids[strings.ToLower(recipe.Name)]
+    err = saveRecipeDef(tx, recipe_id, exists, recipe, ingredient_ids, glass_ids)
+    if err != nil {
+      report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", recipe.Name, err))
+      report.DryRun = true
+      return report
+    }
+  }
+
+  err = tx.Commit()
+  if err != nil {
+    report.Errors = append(report.Errors, err.Error())
+    report.DryRun = true
+  }
+  return report
+}
+
+// saveRecipeDef writes a single recipe to the database
+func saveRecipeDef(tx *sql.Tx, recipe_id int, exists bool, recipe RecipeDef, ingredient_ids map[string]int, glass_ids map[string]int) error {
+  glass_type_id := glass_ids[strings.ToLower(strings.TrimSpace(recipe.Glass))]
+
+  if exists {
+    _, err := tx.Exec("update recipe set glass_type_id = ? where id = ?", glass_type_id, recipe_id)
+    if err != nil {
+      return err
+    }
+  } else {
+    result, err := tx.Exec("insert into recipe (name, glass_type_id) values (?, ?)", recipe.Name, glass_type_id)
+    if err != nil {
+      return err
+    }
+    id, err := result.LastInsertId()
+    if err != nil {
+      return err
+    }
+    recipe_id = int(id)
+  }
+
+  _, err := tx.Exec("delete from recipe_ingredient where recipe_id = ?", recipe_id)
+  if err != nil {
+    return err
+  }
+  for ix, ingr := range recipe.Ingredients {
+    var dispenser_param interface{}
+    if ingr.DispenserParam != nil {
+      dispenser_param = *ingr.DispenserParam
+    }
+    var step_group interface{}
+    if ingr.Group != nil {
+      step_group = *ingr.Group
+    }
+    _, err = tx.Exec(
+      "insert into recipe_ingredient (recipe_id, ingredient_id, seq, qty, dispenser_param, step_group) values (?, ?, ?, ?, ?, ?)",
+      recipe_id,
+      ingredient_ids[strings.ToLower(strings.TrimSpace(ingr.Name))],
+      ix + 1,
+      ingr.Qty,
+      dispenser_param,
+      step_group,
+    )
+    if err != nil {
+      return err
+    }
+  }
+
+  _, err = tx.Exec("delete from recipe_tag where recipe_id = ?", recipe_id)
+  if err != nil {
+    return err
+  }
+  for _, tag := range normaliseTags(recipe.Tags) {
+    _, err = tx.Exec("insert into recipe_tag (recipe_id, tag) values (?, ?)", recipe_id, tag)
+    if err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+// recipeUnchanged checks if the recipe in the database is already the same as recipe
+func recipeUnchanged(db *sql.DB, recipe_id int, recipe RecipeDef) bool {
+  var glass string
+  row := db.QueryRow("select ifnull(gt.name, '') from recipe r left outer join glass_type gt on gt.id = r.glass_type_id where r.id = ?", recipe_id)
+  err := row.Scan(&glass)
+  if err != nil || !strings.EqualFold(glass, strings.TrimSpace(recipe.Glass)) {
+    return false
+  }
+
+  current := getRecipeDefIngredients(db, recipe_id)
+  if len(current) != len(recipe.Ingredients) {
+    return false
+  }
+  for ix, ingr := range recipe.Ingredients {
+    if !strings.EqualFold(current[ix].Name, strings.TrimSpace(ingr.Name)) || current[ix].Qty != ingr.Qty {
+      return false
+    }
+    if (current[ix].DispenserParam == nil) != (ingr.DispenserParam == nil) {
+      return false
+    }
+    if ingr.DispenserParam != nil && *current[ix].DispenserParam != *ingr.DispenserParam {
+      return false
+    }
+    if (current[ix].Group == nil) != (ingr.Group == nil) {
+      return false
+    }
+    if ingr.Group != nil && *current[ix].Group != *ingr.Group {
+      return false
+    }
+  }
+
+  return strings.Join(getRecipeTags(db, recipe_id), ",") == strings.Join(normaliseTags(recipe.Tags), ",")
+}
+
+// normaliseTags trims, de-duplicates and sorts tags
+func normaliseTags(tags []string) []string {
+  var result []string
+  seen := make(map[string]bool)
+  for _, tag := range tags {
+    tag = strings.TrimSpace(tag)
+    if tag == "" || seen[tag] {
+      continue
+    }
+    seen[tag] = true
+    result = append(result, tag)
+  }
+  sort.Strings(result)
+  return result
+}
+
+// getNameLookup runs sqlstr (which should return id, name), and returns a map of lower case name -> id
+func getNameLookup(db *sql.DB, sqlstr string) map[string]int {
+  lookup := make(map[string]int)
+
+  rows, err := db.Query(sqlstr)
+  if err != nil {
+    panic(fmt.Sprintf("getNameLookup failed: %v", err))
+  }
+  defer rows.Close()
+
+  for rows.Next() {
+    var id int
+    var name string
+    rows.Scan(&id, &name)
+    lookup[strings.ToLower(strings.TrimSpace(name))] = id
+  }
+
+  return lookup
+}
+
+// exportRecipesToFile is used for -export-recipes. The format is taken from the file extension.
+func exportRecipesToFile(filename string) error {
+  db := getDBConnection()
+  defer db.Close()
+
+  data, err := encodeRecipes(exportRecipes(db), recipeFileFormat(filename))
+  if err != nil {
+    return err
+  }
+  return ioutil.WriteFile(filename, data, 0644)
+}
+
+// importRecipesFromFile is used for -import-recipes
+func importRecipesFromFile(filename string, dry_run bool) error {
+  data, err := ioutil.ReadFile(filename)
+  if err != nil {
+    return err
+  }
+
+  file, err := decodeRecipes(data)
+  if err != nil {
+    return fmt.Errorf("failed to read %s: %v", filename, err)
+  }
+
+  db := getDBConnection()
+  defer db.Close()
+
+  report := importRecipes(db, file, dry_run)
+  fmt.Printf("%s", report)
+  if !report.Ok() {
+    return fmt.Errorf("nothing imported, as not everything in %s matches the database", filename)
+  }
+  return nil
+}
+
+func recipeFileFormat(filename string) string {
+  if strings.HasSuffix(strings.ToLower(filename), ".json") {
+    return "json"
+  }
+  return "yaml"
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+  "database/sql"
+  "errors"
+  "fmt"
+  "math"
+)
+
+/*
+ * Drink sizes and glass capacity. The volume of a drink is the total of its liquid ingredients (those
+ * measured in ml, i.e. qty * dispenser_type.unit_size), which has to fit in the recipe's glass
+ * (glass_type.size_ml).
+ *
+ * Each order has a size (drink_order.size), which scales the liquid ingredients:
+ *   single  - as the recipe
+ *   double  - twice the recipe (only offered if it fits in the glass)
+ *   fit     - scaled up (or down) to fill the glass
+ * Garnishes, dashes, etc. aren't scaled.
+ */
+
+const (
+  SIZE_SINGLE = "single"
+  SIZE_DOUBLE = "double"
+  SIZE_FIT    = "fit"
+)
+
+var ErrGlassTooSmall = errors.New("Drink won't fit in the glass")
+var ErrUnknownSize = errors.New("Unknown drink size")
+
+// getRecipeVolume returns the volume of liquid in a recipe (before scaling) and the size of its glass, in ml
+func getRecipeVolume(db *sql.DB, recipe_id int) (int, int) {
+  sqlstr := `
+    select
+      ifnull(sum(case when dt.unit_name = 'ml' then ri.qty * dt.unit_size else 0 end), 0),
+      ifnull(max(gt.size_ml), 0)
+    from recipe r
+    left outer join glass_type gt on gt.id = r.glass_type_id
+    left outer join recipe_ingredient ri on ri.recipe_id = r.id
+    left outer join ingredient i on i.id = ri.ingredient_id
+    left outer join dispenser_type dt on dt.id = i.dispenser_type_id
+    where r.id = ?`
+
+  var volume int
+  var glass_ml int
+  row := db.QueryRow(sqlstr, recipe_id)
+  err := row.Scan(&volume, &glass_ml)
+  if err != nil {
+    panic(fmt.Sprintf("getRecipeVolume failed: %v", err))
+  }
+  return volume, glass_ml
+}
+
+// getIngredientVolume returns the volume (in ml) of qty of an ingredient, or 0 if it isn't a liquid
+func getIngredientVolume(db *sql.DB, ingredient_id int, qty int) int {
+  sqlstr := `
+    select case when dt.unit_name = 'ml' then ? * dt.unit_size else 0 end
+    from ingredient i
+    inner join dispenser_type dt on dt.id = i.dispenser_type_id
+    where i.id = ?`
+
+  var volume int
+  row := db.QueryRow(sqlstr, qty, ingredient_id)
+  if err := row.Scan(&volume); err != nil {
+    return 0
+  }
+  return volume
+}
+
+// sizeScale returns how much liquid ingredients should be multiplied by for a size of drink
+func sizeScale(size string, volume int, glass_ml int) (float64, error) {
+  switch size {
+    case SIZE_SINGLE, "":
+      return 1, nil
+    case SIZE_DOUBLE:
+      return 2, nil
+    case SIZE_FIT:
+      if volume <= 0 || glass_ml <= 0 {
+        return 1, nil
+      }
+      return float64(glass_ml) / float64(volume), nil
+  }
+  return 0, ErrUnknownSize
+}
+
+// scaleQty scales a recipe_ingredient.qty. Rounds down, so a drink scaled to fit the glass won't overflow
+// it, but never to nothing.
+func scaleQty(qty int, scale float64) int {
+  scaled := int(math.Floor(float64(qty) * scale + 0.001))
+  if scaled < 1 && qty > 0 {
+    scaled = 1
+  }
+  return scaled
+}
+
+// getDrinkSizes returns the sizes a recipe can be ordered in
+func getDrinkSizes(volume int, glass_ml int) []string {
+  sizes := []string{SIZE_SINGLE}
+  if glass_ml <= 0 || volume <= 0 {
+    return sizes
+  }
+  if volume * 2 <= glass_ml {
+    sizes = append(sizes, SIZE_DOUBLE)
+  }
+  if volume < glass_ml {
+    sizes = append(sizes, SIZE_FIT)
+  }
+  return sizes
+}
+
+// checkDrinkSize checks a recipe can be made in the size requested
+func checkDrinkSize(db *sql.DB, recipe_id int, size string) error {
+  volume, glass_ml := getRecipeVolume(db, recipe_id)
+  for _, s := range getDrinkSizes(volume, glass_ml) {
+    if s == size {
+      return nil
+    }
+  }
+
+  if _, err := sizeScale(size, volume, glass_ml); err != nil {
+    return err
+  }
+  return ErrGlassTooSmall
+}
+
+// scaleIngredients scales the quantities shown for a recipe to the size of drink ordered
+func scaleIngredients(ingredients []MenuItemIngredient, scale float64) {
+  for ix := range ingredients {
+    if ingredients[ix].Liquid {
+      ingredients[ix].ActQty = scaleQty(ingredients[ix].Qty, scale) * ingredients[ix].UnitSize
+    }
+  }
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+  "bufio"
+  "fmt"
+  "io"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+/*
+ * BarbotSimulator stands in for the barbot firmware (src/arduino/BarBotSerial), so the web
+ * server can be run without the real hardware. It speaks the same line protocol, keeping the
+ * same limits (MAX_INSTRUCTIONS, DISPENSER_COUNT, MAX_RAIL_POSITION) and approximate timings
+ * for platform moves and each type of dispenser.
+ *
+ * The web server talks to it in-process: Connect returns an io.ReadWriteCloser, used in place of the serial port.
+ */
+
+const SIM_TICK = 10 * time.Millisecond
+
+type simInstruction struct {
+  Type    byte   // 'M', 'D' or 'Z'
+  Param1  int
+  Param2  int
+}
+
+type BarbotSimulator struct {
+  mu              sync.Mutex
+  state           string
+  instructions    []simInstruction
+  current         int
+  glassPresent    bool
+
+  // Platform movement
+  moveFrom        int
+  moveTarget      int
+  moveStart       time.Time
+  moveTime        time.Duration
+
+  // Current instruction
+  stepStart       time.Time
+  stepTime        time.Duration
+  opticLastUsed   map[int]time.Time
+
+  in              chan string     // Instructions from the web server
+  out             chan string     // Messages to the web server
+}
+
+// simConnection is a connection to the simulator from the web server, like plugging in the serial cable
+type simConnection struct {
+  hostR  *io.PipeReader  // web server reads replies from here...
+  hostW  *io.PipeWriter  // ...and writes instructions here
+}
+
+// NewBarbotSimulator starts a simulated barbot, in the same state as the real one after power on
+func NewBarbotSimulator() *BarbotSimulator {
+  sim := &BarbotSimulator{
+    state:          STATE_UNKNOWN,
+    glassPresent:   true,
+    opticLastUsed:  make(map[int]time.Time),
+    in:             make(chan string),
+    out:            make(chan string, 100),
+  }
+
+  sim.setState(STATE_IDLE, "")
+
+  go sim.run()
+  return sim
+}
+
+// Connect returns a new connection to the simulator. The simulator carries on (with the platform where it
+// was) when a connection is closed, ready for the next one.
+func (sim *BarbotSimulator) Connect() io.ReadWriteCloser {
+  simR, hostW := io.Pipe()
+  hostR, simW := io.Pipe()
+  done := make(chan bool)
+
+  // Anything sent whilst nothing was connected is lost, as it would be on the serial port
+  for drained := false; !drained; {
+    select {
+      case <-sim.out:
+      default:
+        drained = true
+    }
+  }
+
+  // Instructions from the web server
+  go func() {
+    defer close(done)
+    reader := bufio.NewReader(simR)
+    for {
+      buf, err := reader.ReadString('\n')
+      if err != nil {
+        return
+      }
+      sim.in <- strings.Trim(buf, "\r\n")
+    }
+  }()
+
+  // Messages to the web server
+  go func() {
+    for {
+      select {
+        case msg := <-sim.out:
+          _, err := simW.Write([]byte(msg + "\r\n"))
+          if err != nil {
+            return
+          }
+        case <-done:
+          return
+      }
+    }
+  }()
+
+  return &simConnection{hostR: hostR, hostW: hostW}
+}
+
+// Read returns messages sent by the simulated barbot
+func (c *simConnection) Read(p []byte) (int, error) {
+  return c.hostR.Read(p)
+}
+
+// Write passes instructions to the simulated barbot
+func (c *simConnection) Write(p []byte) (int, error) {
+  return c.hostW.Write(p)
+}
+
+func (c *simConnection) Close() error {
+  c.hostW.Close()
+  c.hostR.Close()
+  return nil
+}
+
+// SetGlassPresent simulates a glass being placed on, or removed from, the platform
+func (sim *BarbotSimulator) SetGlassPresent(present bool) {
+  sim.mu.Lock()
+  defer sim.mu.Unlock()
+  sim.glassPresent = present
+}
+
+// GlassPresent returns the state of the simulated glass sensor
+func (sim *BarbotSimulator) GlassPresent() bool {
+  sim.mu.Lock()
+  defer sim.mu.Unlock()
+  return sim.glassPresent
+}
+
+// Position returns the current (simulated) rail position of the platform
+func (sim *BarbotSimulator) Position() int {
+  sim.mu.Lock()
+  defer sim.mu.Unlock()
+  return sim.position()
+}
+
+func (sim *BarbotSimulator) run() {
+  ticker := time.NewTicker(SIM_TICK)
+  defer ticker.Stop()
+
+  for {
+    select {
+      case msg := <-sim.in:
+        sim.mu.Lock()
+        sim.processMessage(msg)
+        sim.mu.Unlock()
+
+      case <-ticker.C:
+        sim.mu.Lock()
+        sim.loop()
+        sim.mu.Unlock()
+    }
+  }
+}
+
+// processMessage handles an instruction from the web server, as process_message() in BarBotSerial.ino does
+func (sim *BarbotSimulator) processMessage(msg string) {
+  fields := strings.Fields(msg)
+  seq := 0
+
+  if len(fields) > 0 && fields[0][0] >= '0' && fields[0][0] <= '9' {
+    seq, _ = strconv.Atoi(fields[0])
+    seq &= MAX_PARAM
+    fields = fields[1:]
+  }
+
+  if len(fields) == 0 {
+    sim.replyErr(seq, "invalid message")
+    return
+  }
+
+  // Parameters are uint16_t on barbot, so wrap the same way
+  var params []int
+  for _, f := range fields[1:] {
+    p, err := strconv.Atoi(f)
+    if err != nil {
+      break
+    }
+    params = append(params, p & MAX_PARAM)
+  }
+
+  if fields[0][0] == 'S' {
+    sim.send(fmt.Sprintf("S %s", sim.state))
+    sim.send(fmt.Sprintf("OK %d", seq))
+    return
+  }
+
+  if sim.state == STATE_RUNNING {
+    sim.replyErr(seq, "busy")
+    return
+  }
+
+  switch fields[0][0] {
+    case 'C':
+      sim.instructions = nil
+
+    case 'M':
+      if len(params) < 1 {
+        sim.replyErr(seq, "parameter missing")
+        return
+      }
+      if !sim.instructionAdd('M', params[0], 0) {
+        sim.replyErr(seq, "instruction rejected")
+        return
+      }
+
+    case 'D':
+      if len(params) < 2 {
+        sim.replyErr(seq, "parameter missing")
+        return
+      }
+      if !sim.instructionAdd('D', params[0], params[1]) {
+        sim.replyErr(seq, "instruction rejected")
+        return
+      }
+
+    case 'G':
+      if !sim.goCmd() {
+        sim.replyErr(seq, "go failed")
+        return
+      }
+
+    case 'R':
+      sim.setState(STATE_FAULT, "reset")
+      sim.instructions = nil
+      sim.startMove(0, SPEED_NORMAL)
+      sim.setState(STATE_IDLE, "")
+
+    case 'Z':
+      sim.instructions = nil
+      sim.instructionAdd('Z', 0, 0)
+      sim.goCmd()
+
+    default:
+      sim.replyErr(seq, "unexpected instruction")
+      return
+  }
+
+  sim.send(fmt.Sprintf("OK %d", seq))
+}
+
+func (sim *BarbotSimulator) instructionAdd(typ byte, param1 int, param2 int) bool {
+  if typ == 'D' && param1 >= DISPENSER_COUNT {
+    return false
+  }
+  if len(sim.instructions) >= MAX_INSTRUCTIONS {
+    return false
+  }
+  sim.instructions = append(sim.instructions, simInstruction{Type: typ, Param1: param1, Param2: param2})
+  return true
+}
+
+func (sim *BarbotSimulator) goCmd() bool {
+  if sim.state != STATE_IDLE || len(sim.instructions) == 0 {
+    return false
+  }
+
+  sim.current = 0
+  if !sim.glassPresent {
+    sim.setState(STATE_WAITING, "")
+  } else {
+    sim.execInstruction()
+    sim.setState(STATE_RUNNING, "")
+  }
+  return true
+}
+
+// execInstruction starts the current instruction
+func (sim *BarbotSimulator) execInstruction() {
+  ins := sim.instructions[sim.current]
+  now := time.Now()
+  sim.stepStart = now
+  sim.stepTime = 0
+
+  switch ins.Type {
+    case 'M':
+      target := ins.Param1
+      if target > MAX_RAIL_POSITION {
+        target = MAX_RAIL_POSITION
+      }
+      sim.startMove(target, SPEED_NORMAL)
+      sim.stepTime = sim.moveTime
+
+    case 'Z':
+      sim.startMove(MAX_RAIL_POSITION, SPEED_ZERO)
+      sim.stepTime = sim.moveTime
+
+    case 'D':
+      dispenser_type := firmwareDispenserType(ins.Param1)
+      if dispenser_type == DISPENSER_OPTIC {
+        // Optics need time to refill between uses
+        if last, ok := sim.opticLastUsed[ins.Param1]; ok && now.Sub(last) < OPTIC_RECHARGE_TIME * time.Millisecond {
+          sim.stepTime = OPTIC_RECHARGE_TIME * time.Millisecond - now.Sub(last)
+        }
+      }
+      sim.stepTime += dispenseDuration(dispenser_type, ins.Param2)
+      if dispenser_type == DISPENSER_OPTIC {
+        sim.opticLastUsed[ins.Param1] = now.Add(sim.stepTime)
+      }
+  }
+}
+
+// loop advances the simulation, as BarBot::loop() does
+func (sim *BarbotSimulator) loop() {
+  if sim.state == STATE_WAITING && sim.glassPresent {
+    sim.execInstruction()
+    sim.setState(STATE_RUNNING, "")
+    return
+  }
+
+  if sim.state != STATE_RUNNING {
+    return
+  }
+
+  if !sim.glassPresent {
+    sim.fault("glass removed")
+    return
+  }
+
+  elapsed := time.Since(sim.stepStart)
+  ins := sim.instructions[sim.current]
+
+  if (ins.Type == 'M' || ins.Type == 'Z') && elapsed > MAX_MOVE_TIME * time.Millisecond {
+    if ins.Type == 'Z' {
+      sim.fault("zero timeout")
+    } else {
+      sim.fault("move timeout")
+    }
+    return
+  }
+
+  if elapsed < sim.stepTime {
+    return
+  }
+
+  sim.current++
+  if sim.current >= len(sim.instructions) {
+    sim.setState(STATE_IDLE, "")
+    return
+  }
+  sim.execInstruction()
+}
+
+func (sim *BarbotSimulator) fault(reason string) {
+  // Stop the platform where it is
+  pos := sim.position()
+  sim.moveFrom = pos
+  sim.moveTarget = pos
+  sim.moveTime = 0
+  sim.setState(STATE_FAULT, reason)
+}
+
+func (sim *BarbotSimulator) startMove(target int, speed int) {
+  sim.moveFrom = sim.position()
+  sim.moveTarget = target
+  sim.moveStart = time.Now()
+  sim.moveTime = moveDuration(target - sim.moveFrom, speed)
+}
+
+// position works out where the platform is part way through a move. Movement is treated
+// as linear, which is near enough for display purposes.
+func (sim *BarbotSimulator) position() int {
+  elapsed := time.Since(sim.moveStart)
+  if sim.moveTime <= 0 || elapsed >= sim.moveTime {
+    return sim.moveTarget
+  }
+  return sim.moveFrom + int(float64(sim.moveTarget - sim.moveFrom) * float64(elapsed) / float64(sim.moveTime))
+}
+
+func (sim *BarbotSimulator) setState(state string, reason string) {
+  if state == sim.state {
+    return
+  }
+  sim.state = state
+  if reason != "" {
+    sim.send(fmt.Sprintf("S %s %s", state, reason))
+  } else {
+    sim.send(fmt.Sprintf("S %s", state))
+  }
+}
+
+func (sim *BarbotSimulator) replyErr(seq int, reason string) {
+  sim.send(fmt.Sprintf("ERR %d %s", seq, reason))
+}
+
+func (sim *BarbotSimulator) send(msg string) {
+  select {
+    case sim.out <- msg:
+    default:
+      // Nobody listening - the same as the real thing, messages just get lost
+  }
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+  "bufio"
+  "fmt"
+  "io"
+  "strings"
+  "testing"
+  "time"
+)
+
+// simClient drives a simulated barbot through SimulatorTransport, the same way BBSerial would
+type simClient struct {
+  t       *testing.T
+  sim     *BarbotSimulator
+  port    io.ReadWriteCloser
+  lines   chan string
+  seq     int
+  states  []string  // State telemetry received so far, e.g. "S RUNNING"
+}
+
+func newSimClient(t *testing.T, sim *BarbotSimulator) *simClient {
+  transport := &SimulatorTransport{Sim: sim}
+  port, err := transport.Open()
+  if err != nil {
+    t.Fatalf("Open: %v", err)
+  }
+
+  c := &simClient{t: t, sim: sim, port: port, lines: make(chan string, 100)}
+  go func() {
+    reader := bufio.NewReader(port)
+    for {
+      buf, err := reader.ReadString('\n')
+      if err != nil {
+        return
+      }
+      c.lines <- strings.Trim(buf, "\r\n")
+    }
+  }()
+  return c
+}
+
+// next returns the next message from the simulator, recording it if it's state telemetry
+func (c *simClient) next(timeout time.Duration) string {
+  select {
+    case msg := <-c.lines:
+      if _, _, ok := parseTelemetry(msg); ok {
+        c.states = append(c.states, msg)
+      }
+      return msg
+    case <-time.After(timeout):
+      c.t.Fatalf("nothing received from simulator after %v", timeout)
+  }
+  return ""
+}
+
+// send transmits cmd and returns the reply to it
+func (c *simClient) send(cmd string) BarbotReply {
+  c.seq = nextSeq(c.seq)
+  _, err := c.port.Write([]byte(formatCommand(c.seq, cmd)))
+  if err != nil {
+    c.t.Fatalf("write [%s]: %v", cmd, err)
+  }
+
+  for {
+    msg := c.next(REPLY_TIMEOUT)
+    reply, ok := parseReply(msg)
+    if !ok {
+      continue
+    }
+    if reply.Seq != c.seq {
+      c.t.Fatalf("[%s]: got reply to %d, expected %d", cmd, reply.Seq, c.seq)
+    }
+    return reply
+  }
+}
+
+func (c *simClient) expectOk(cmd string) {
+  reply := c.send(cmd)
+  if !reply.Ok {
+    c.t.Fatalf("[%s]: expected OK, got ERR %s", cmd, reply.Reason)
+  }
+}
+
+func (c *simClient) expectErr(cmd string, reason string) {
+  reply := c.send(cmd)
+  if reply.Ok {
+    c.t.Fatalf("[%s]: expected ERR %s, got OK", cmd, reason)
+  }
+  if reply.Reason != reason {
+    c.t.Fatalf("[%s]: expected ERR %s, got ERR %s", cmd, reason, reply.Reason)
+  }
+}
+
+// waitForState waits for the simulator to report state, failing if it reports a fault instead
+func (c *simClient) waitForState(state string, timeout time.Duration) {
+  for _, msg := range c.states {
+    if msg == "S " + state {
+      c.states = nil
+      return
+    }
+  }
+
+  deadline := time.Now().Add(timeout)
+  for {
+    msg := c.next(deadline.Sub(time.Now()))
+    s, reason, ok := parseTelemetry(msg)
+    if !ok {
+      continue
+    }
+    if s == state {
+      c.states = nil
+      return
+    }
+    if s == STATE_FAULT {
+      c.t.Fatalf("waiting for %s: barbot faulted (%s)", state, reason)
+    }
+  }
+}
+
+// setPosition puts the simulated platform at position, without the wait for it to get there
+func (c *simClient) setPosition(position int) {
+  c.sim.mu.Lock()
+  defer c.sim.mu.Unlock()
+  c.sim.moveFrom = position
+  c.sim.moveTarget = position
+  c.sim.moveTime = 0
+}
+
+func TestSimulatorState(t *testing.T) {
+  c := newSimClient(t, NewBarbotSimulator())
+  defer c.port.Close()
+
+  c.expectOk("S")
+  if len(c.states) == 0 || c.states[len(c.states)-1] != "S " + STATE_IDLE {
+    t.Fatalf("expected S %s in reply to S, got %v", STATE_IDLE, c.states)
+  }
+}
+
+func TestSimulatorMoveAndDispense(t *testing.T) {
+  c := newSimClient(t, NewBarbotSimulator())
+  defer c.port.Close()
+
+  c.expectOk("C")
+  c.expectOk("M 300")
+  c.expectOk("D 7 50")   // Mixer: 50ms
+  c.expectOk("M 150")
+  c.expectOk("G")
+  c.waitForState(STATE_RUNNING, time.Second)
+
+  // Nothing else is accepted until it's finished
+  c.expectErr("C", "busy")
+  c.expectErr("M 10", "busy")
+
+  c.waitForState(STATE_IDLE, 5 * time.Second)
+  if pos := c.sim.Position(); pos != 150 {
+    t.Fatalf("expected platform at 150, got %d", pos)
+  }
+}
+
+func TestSimulatorZero(t *testing.T) {
+  c := newSimClient(t, NewBarbotSimulator())
+  defer c.port.Close()
+
+  // Zeroing is slow, so start near the zero switch
+  c.setPosition(MAX_RAIL_POSITION - 50)
+
+  c.expectOk("C")
+  c.expectOk("M 100")
+  c.expectOk("Z")   // Starts straight away, clearing the move above
+
+  c.waitForState(STATE_RUNNING, time.Second)
+  c.expectErr("G", "busy")
+  c.waitForState(STATE_IDLE, 5 * time.Second)
+
+  if pos := c.sim.Position(); pos != ZERO_POSITION {
+    t.Fatalf("expected platform at %d after zeroing, got %d", ZERO_POSITION, pos)
+  }
+}
+
+func TestSimulatorErrors(t *testing.T) {
+  c := newSimClient(t, NewBarbotSimulator())
+  defer c.port.Close()
+
+  tests := []struct {
+    cmd     string
+    reason  string
+  }{
+    {"C", ""},
+    {"G", "go failed"},   // Nothing to do
+    {"M", "parameter missing"},
+    {"D 7", "parameter missing"},
+    {fmt.Sprintf("D %d 10", DISPENSER_COUNT), "instruction rejected"},
+    {"X", "unexpected instruction"},
+  }
+
+  for _, test := range tests {
+    if test.reason == "" {
+      c.expectOk(test.cmd)
+    } else {
+      c.expectErr(test.cmd, test.reason)
+    }
+  }
+
+  c.expectOk("C")
+  for i := 0; i < MAX_INSTRUCTIONS; i++ {
+    c.expectOk("D 7 1")
+  }
+  c.expectErr("D 7 1", "instruction rejected")
+}
+
+func TestSimulatorGlass(t *testing.T) {
+  c := newSimClient(t, NewBarbotSimulator())
+  defer c.port.Close()
+
+  c.sim.SetGlassPresent(false)
+  c.expectOk("C")
+  c.expectOk("D 7 10")
+  c.expectOk("G")
+  c.waitForState(STATE_WAITING, time.Second)
+
+  c.sim.SetGlassPresent(true)
+  c.waitForState(STATE_RUNNING, time.Second)
+  c.waitForState(STATE_IDLE, time.Second)
+}
+
+func TestSimulatorReset(t *testing.T) {
+  c := newSimClient(t, NewBarbotSimulator())
+  defer c.port.Close()
+
+  c.setPosition(100)
+  c.expectOk("R")
+  if len(c.states) < 2 || c.states[0] != "S " + STATE_FAULT + " reset" || c.states[1] != "S " + STATE_IDLE {
+    t.Fatalf("expected S %s reset then S %s, got %v", STATE_FAULT, STATE_IDLE, c.states)
+  }
+
+  time.Sleep(time.Second)
+  if pos := c.sim.Position(); pos != 0 {
+    t.Fatalf("expected platform at 0 after reset, got %d", pos)
+  }
+}
+
+func TestSimulatorReconnect(t *testing.T) {
+  sim := NewBarbotSimulator()
+
+  c := newSimClient(t, sim)
+  c.expectOk("C")
+  c.expectOk("M 200")
+  c.expectOk("G")
+  c.waitForState(STATE_IDLE, 5 * time.Second)
+  c.port.Close()
+
+  // The simulator (and the platform) is still there for the next connection
+  c = newSimClient(t, sim)
+  c.expectOk("S")
+  if pos := sim.Position(); pos != 200 {
+    t.Fatalf("expected platform still at 200 after reconnecting, got %d", pos)
+  }
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+  "database/sql"
+  "fmt"
+  "strconv"
+  "strings"
+)
+
+/*
+ * Dispenser stock levels. dispenser.capacity is how much a full bottle (or hopper, etc.) holds, and
+ * dispenser.stock how much is left, both in the units shown to the user (e.g. ml for optics and mixers,
+ * dashes for dashers). If capacity is null the dispenser's stock isn't tracked, and it's assumed to never
+ * run out. dispenser.low_stock is the level at which it's shown as running low (see alerts.go).
+ *
+ * Stock is taken off as each drink is sent to barbot, using the amounts from getCommandListAndUsage. A drink
+ * sent in batches has each batch's share taken off as that batch is sent (see splitUsage), so if a later
+ * batch never gets sent, what it would have used is still counted as there.
+ */
+
+// useStock takes the amounts used to make a drink off the dispenser stock levels
+func useStock(db *sql.DB, usage map[int]int) {
+  for dispenser_id, amount := range usage {
+    _, err := db.Exec(
+      "update dispenser set stock = max(stock - ?, 0) where id = ? and stock is not null",
+      amount,
+      dispenser_id,
+    )
+    if err != nil {
+      // Called from the dispatcher, so don't panic
+      fmt.Printf("useStock: failed to update dispenser %d: %v\n", dispenser_id, err)
+    }
+  }
+
+  checkStockAlerts(db)
+}
+
+// splitUsage splits the amounts used to make a drink between the batches of instructions it's sent in, in
+// proportion to the number of "D" instructions for each dispenser in each batch
+func splitUsage(usage map[int]int, batches [][]string) []map[int]int {
+  counts := make([]map[int]int, len(batches))
+  totals := make(map[int]int)
+  for ix, batch := range batches {
+    counts[ix] = make(map[int]int)
+    for _, cmd := range batch {
+      fields := strings.Fields(cmd)
+      if len(fields) < 2 || fields[0] != "D" {
+        continue
+      }
+      dispenser_id, err := strconv.Atoi(fields[1])
+      if err != nil {
+        continue
+      }
+      counts[ix][dispenser_id]++
+      totals[dispenser_id]++
+    }
+  }
+
+  shares := make([]map[int]int, len(batches))
+  sent := make(map[int]int)  // D instructions for each dispenser in the batches so far
+  for ix := range batches {
+    shares[ix] = make(map[int]int)
+    for dispenser_id, count := range counts[ix] {
+      amount := usage[dispenser_id]
+      total := totals[dispenser_id]
+      // Worked out from the running total, so the shares add up to exactly the amount used
+      shares[ix][dispenser_id] = amount * (sent[dispenser_id] + count) / total - amount * sent[dispenser_id] / total
+      sent[dispenser_id] += count
+    }
+  }
+  return shares
+}
+
+// restockDispenser marks a dispenser as full, e.g. after a new bottle has been put in
+func restockDispenser(db *sql.DB, dispenser_id string) error {
+  _, err := db.Exec("update dispenser set stock = capacity where id = ?", dispenser_id)
+  return err
+}
+
+// setDispenserStock sets the capacity, current stock and low stock threshold of a dispenser. A capacity of 0
+// stops its stock being tracked; a low_stock of 0 means use the default (LowStockPercent of the capacity).
+func setDispenserStock(db *sql.DB, dispenser_id string, capacity int, stock int, low_stock int) error {
+  if capacity <= 0 {
+    _, err := db.Exec("update dispenser set capacity = null, stock = null, low_stock = null where id = ?", dispenser_id)
+    return err
+  }
+
+  if stock < 0 {
+    stock = 0
+  }
+  if stock > capacity {
+    stock = capacity
+  }
+
+  var low_stock_val interface{}
+  if low_stock > 0 {
+    low_stock_val = low_stock
+  }
+  _, err := db.Exec("update dispenser set capacity = ?, stock = ?, low_stock = ? where id = ?", capacity, stock, low_stock_val, dispenser_id)
+  return err
+}
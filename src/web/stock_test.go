@@ -0,0 +1,32 @@
+package main
+
+import (
+  "reflect"
+  "testing"
+)
+
+func TestSplitUsage(t *testing.T) {
+  batches := [][]string{
+    {"C", "M 100", "D 1 3000", "D 1 3000", "M 200", "D 7 500", "G"},
+    {"C", "M 100", "D 1 3000", "M 300", "D 13 0", "G"},
+  }
+  usage := map[int]int{1: 75, 7: 50, 13: 1, 9: 10}   // Nothing sent to 9
+
+  expected := []map[int]int{
+    {1: 50, 7: 50},
+    {1: 25, 13: 1},
+  }
+  if shares := splitUsage(usage, batches); !reflect.DeepEqual(shares, expected) {
+    t.Errorf("got %v, expected %v", shares, expected)
+  }
+
+  // Shares that don't divide exactly still add up to the amount used
+  batches = [][]string{{"C", "D 2 1", "G"}, {"C", "D 2 1", "G"}, {"C", "D 2 1", "G"}}
+  total := 0
+  for _, share := range splitUsage(map[int]int{2: 100}, batches) {
+    total += share[2]
+  }
+  if total != 100 {
+    t.Errorf("shares of 100 add up to %d", total)
+  }
+}
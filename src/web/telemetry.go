@@ -0,0 +1,158 @@
+package main
+
+import (
+  "fmt"
+  "strings"
+  "sync"
+  "time"
+)
+
+/*
+ * State change messages sent by barbot whenever its state changes:
+ *
+ *   S <state> [reason]
+ *
+ * where state is one of IDLE, WAITING (for a glass), RUNNING or FAULT. For FAULT,
+ * reason describes what went wrong (e.g. "glass removed", "move timeout").
+ * Sending the "S" instruction asks barbot to report its current state.
+ */
+
+const (
+  STATE_UNKNOWN = "UNKNOWN"
+  STATE_IDLE    = "IDLE"
+  STATE_WAITING = "WAITING"
+  STATE_RUNNING = "RUNNING"
+  STATE_FAULT   = "FAULT"
+)
+
+// MachineStatus describes what barbot is currently doing
+type MachineStatus struct {
+  State         string     `json:"state"`
+  FaultReason   string     `json:"fault_reason,omitempty"`
+  Updated       time.Time  `json:"updated"`
+  OrderId       int        `json:"order_id,omitempty"`  // drink_order.id currently being made, 0 if none
+  Batch         int        `json:"batch,omitempty"`     // If it's being sent in batches, the one being made...
+  Batches       int        `json:"batches,omitempty"`   // ...out of how many
+}
+
+// MachineState is the live model of barbot, updated from the state change messages it sends
+type MachineState struct {
+  mu      sync.Mutex
+  status  MachineStatus
+}
+
+var BarbotMachine = &MachineState{status: MachineStatus{State: STATE_UNKNOWN}}
+
+// parseTelemetry checks if msg is a state change message, and if so returns the new state and reason
+func parseTelemetry(msg string) (string, string, bool) {
+  fields := strings.SplitN(msg, " ", 3)
+  if len(fields) < 2 || fields[0] != "S" {
+    return "", "", false
+  }
+
+  switch fields[1] {
+    case STATE_IDLE, STATE_WAITING, STATE_RUNNING, STATE_FAULT:
+    default:
+      return "", "", false
+  }
+
+  reason := ""
+  if len(fields) > 2 {
+    reason = fields[2]
+  }
+
+  return fields[1], reason, true
+}
+
+// Snapshot returns a copy of the current status
+func (m *MachineState) Snapshot() MachineStatus {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  return m.status
+}
+
+// SetOrder records which order (and which batch of its instructions) barbot has been asked to make
+func (m *MachineState) SetOrder(drink_order_id int, batch int, batches int) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  m.status.OrderId = drink_order_id
+  m.status.Batch = batch
+  m.status.Batches = batches
+}
+
+// Disconnected is called when the link to barbot is lost, as its state is no longer known
+func (m *MachineState) Disconnected() {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  m.status.State = STATE_UNKNOWN
+  m.status.Updated = time.Now()
+}
+
+// Update applies a state change reported by barbot, completing or failing the current order as required
+func (m *MachineState) Update(state string, reason string) {
+  m.mu.Lock()
+  prev_state := m.status.State
+  drink_order_id := m.status.OrderId
+  batch := m.status.Batch
+  batches := m.status.Batches
+  m.status.State = state
+  m.status.Updated = time.Now()
+  if state == STATE_FAULT {
+    m.status.FaultReason = reason
+  } else {
+    m.status.FaultReason = ""
+  }
+  if drink_order_id > 0 && (state == STATE_FAULT || (state == STATE_IDLE && prev_state == STATE_RUNNING)) {
+    m.status.OrderId = 0
+    m.status.Batch = 0
+    m.status.Batches = 0
+  }
+  m.mu.Unlock()
+
+  fmt.Printf("BarBot state: %s -> %s %s\n", prev_state, state, reason)
+
+  // Resetting reports a FAULT on the way back to IDLE, but that doesn't lose the platform
+  if state == STATE_FAULT && reason != "reset" {
+    setParkedAtUnknown()
+  }
+
+  if drink_order_id <= 0 {
+    return
+  }
+
+  if state == prev_state {
+    return
+  }
+
+  switch {
+    case state == STATE_FAULT:
+      if reason == "" {
+        reason = "fault"
+      }
+      updateOrderStatus(drink_order_id, ORDER_FAILED, reason)
+
+    case batch > 1 && (state == STATE_WAITING || state == STATE_RUNNING):
+      // Carrying on with the next batch of a long order - it's already making
+
+    case state == STATE_WAITING:
+      updateOrderStatus(drink_order_id, ORDER_WAITING_FOR_GLASS, "")
+
+    case state == STATE_RUNNING:
+      updateOrderStatus(drink_order_id, ORDER_MAKING, "")
+
+    case state == STATE_IDLE && prev_state == STATE_RUNNING && batch < batches:
+      // The dispatcher sends the next batch
+      fmt.Printf("Order [%d]: batch %d of %d done\n", drink_order_id, batch, batches)
+
+    case state == STATE_IDLE && prev_state == STATE_RUNNING:
+      updateOrderStatus(drink_order_id, ORDER_DONE, "")
+  }
+}
+
+// handleTelemetry processes a non-reply message received from barbot
+func handleTelemetry(msg string) {
+  state, reason, ok := parseTelemetry(msg)
+  if ok {
+    BarbotMachine.Update(state, reason)
+  }
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+  "fmt"
+  "io"
+  "net"
+  "time"
+
+  "github.com/tarm/goserial"
+)
+
+// BarbotTransport is a way of connecting to barbot. The same line protocol is used whatever the transport.
+type BarbotTransport interface {
+  Open() (io.ReadWriteCloser, error)
+  String() string
+}
+
+// SerialTransport connects to barbot over a local serial port
+type SerialTransport struct {
+  Port  string
+  Baud  int
+}
+
+func (t *SerialTransport) Open() (io.ReadWriteCloser, error) {
+  return serial.OpenPort(&serial.Config{Name: t.Port, Baud: t.Baud})
+}
+
+func (t *SerialTransport) String() string {
+  return fmt.Sprintf("serial port %s", t.Port)
+}
+
+// TCPTransport connects to barbot over the network, e.g. to ser2net (in raw mode) running on the Pi
+type TCPTransport struct {
+  Address  string
+}
+
+func (t *TCPTransport) Open() (io.ReadWriteCloser, error) {
+  return net.DialTimeout("tcp", t.Address, 5 * time.Second)
+}
+
+func (t *TCPTransport) String() string {
+  return fmt.Sprintf("tcp %s", t.Address)
+}
+
+// SimulatorTransport connects to an in-memory simulated barbot. The simulator is created once (in main), and each
+// Open connects to it afresh, so it keeps its state (rail position, glass etc.) if the link is dropped and reopened.
+type SimulatorTransport struct {
+  Sim  *BarbotSimulator
+}
+
+func (t *SimulatorTransport) Open() (io.ReadWriteCloser, error) {
+  return t.Sim.Connect(), nil
+}
+
+func (t *SimulatorTransport) String() string {
+  return "simulator"
+}
+
+// newTransport returns the transport selected by the -transport flag. sim is the simulator to use for -transport sim.
+func newTransport(kind string, serialPort string, address string, sim *BarbotSimulator) (BarbotTransport, error) {
+  switch kind {
+    case "serial":
+      return &SerialTransport{Port: serialPort, Baud: 115200}, nil
+    case "tcp":
+      return &TCPTransport{Address: address}, nil
+    case "sim":
+      if sim == nil {
+        return nil, fmt.Errorf("no simulator for -transport sim")
+      }
+      return &SimulatorTransport{Sim: sim}, nil
+  }
+  return nil, fmt.Errorf("unknown transport [%s] - should be serial, tcp or sim", kind)
+}